@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// cidrList is a parsed list of networks from the configuration
+type cidrList []*net.IPNet
+
+// parseCIDRList parses CIDR entries; a bare IP address is treated as a single-host network
+func parseCIDRList(entries []string) (cidrList, error) {
+	var list cidrList
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", entry, err)
+		}
+		list = append(list, ipNet)
+	}
+	return list, nil
+}
+
+// contains reports whether ip belongs to any network in the list
+func (l cidrList) contains(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range l {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter decides which client addresses may use a listener or a local account
+type ipFilter struct {
+	allow cidrList
+	deny  cidrList
+}
+
+// newIPFilter parses allow/deny lists. An empty allow list admits everyone not denied.
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	allowList, err := parseCIDRList(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	denyList, err := parseCIDRList(deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return &ipFilter{allow: allowList, deny: denyList}, nil
+}
+
+// permits reports whether ip may connect; deny entries win over allow entries
+func (f *ipFilter) permits(ip string) bool {
+	if f == nil {
+		return true
+	}
+	if f.deny.contains(ip) {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow.contains(ip)
+}
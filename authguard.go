@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// passwordsEqual compares passwords in constant time
+func passwordsEqual(expected, given string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(given)) == 1
+}
+
+// maxFailureRecords bounds the tracking maps before stale entries are pruned
+const maxFailureRecords = 4096
+
+// failureRecord tracks failed logins for one client IP or username
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+	bans        int // bans so far, used to escalate the ban duration
+}
+
+// authGuard slows down and temporarily bans clients that keep failing
+// authentication. It is shared by the POP3 and SMTP listeners.
+type authGuard struct {
+	mu        sync.Mutex
+	cfg       AuthGuardConfig
+	allowlist cidrList
+	ips       map[string]*failureRecord
+	users     map[string]*failureRecord
+}
+
+func newAuthGuard(cfg AuthGuardConfig) (*authGuard, error) {
+	allowlist, err := parseCIDRList(cfg.Allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("auth_guard allowlist: %w", err)
+	}
+	return &authGuard{
+		cfg:       cfg,
+		allowlist: allowlist,
+		ips:       make(map[string]*failureRecord),
+		users:     make(map[string]*failureRecord),
+	}, nil
+}
+
+// exempt reports whether the guard leaves ip alone
+func (g *authGuard) exempt(ip string) bool {
+	return g.cfg.Disabled || g.allowlist.contains(ip)
+}
+
+// bannedIP reports whether ip is currently banned
+func (g *authGuard) bannedIP(ip string) bool {
+	if g.exempt(ip) {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.isBanned(g.ips, ip, time.Now())
+}
+
+// banned reports whether a login attempt from ip for username must be refused
+func (g *authGuard) banned(ip, username string) bool {
+	if g.exempt(ip) {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	return g.isBanned(g.ips, ip, now) || g.isBanned(g.users, strings.ToLower(username), now)
+}
+
+func (g *authGuard) isBanned(records map[string]*failureRecord, key string, now time.Time) bool {
+	record := records[key]
+	return record != nil && now.Before(record.bannedUntil)
+}
+
+// failure records a failed login and returns how long the caller should wait
+// before answering the client
+func (g *authGuard) failure(ip, username, protocol string) time.Duration {
+	if g.exempt(ip) {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	ipRecord := g.record(g.ips, ip, now)
+	userRecord := g.record(g.users, strings.ToLower(username), now)
+
+	failures := ipRecord.failures
+	if userRecord.failures > failures {
+		failures = userRecord.failures
+	}
+	LogInfo("🔐 %s authentication failure %d for user %q from %s", protocol, failures, username, ip)
+
+	if ipRecord.failures >= g.cfg.MaxFailures {
+		g.ban(ipRecord, now, "IP "+ip)
+	}
+	if userRecord.failures >= g.cfg.MaxFailures {
+		g.ban(userRecord, now, fmt.Sprintf("user %q", username))
+	}
+
+	// Escalating delay: BaseDelay, 2x, 4x, ... up to MaxDelay
+	delay := g.cfg.BaseDelay
+	for i := 1; i < failures && delay < g.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.cfg.MaxDelay {
+		delay = g.cfg.MaxDelay
+	}
+	return delay
+}
+
+// record returns the failure record for key after counting one more failure.
+// Failures older than FailureWindow are forgotten.
+func (g *authGuard) record(records map[string]*failureRecord, key string, now time.Time) *failureRecord {
+	record := records[key]
+	if record == nil {
+		if len(records) >= maxFailureRecords {
+			g.prune(records, now)
+		}
+		record = &failureRecord{}
+		records[key] = record
+	}
+	if now.Sub(record.lastFailure) > g.cfg.FailureWindow {
+		record.failures = 0
+	}
+	record.failures++
+	record.lastFailure = now
+	return record
+}
+
+// ban bans a record, doubling the duration for repeat offenders
+func (g *authGuard) ban(record *failureRecord, now time.Time, who string) {
+	duration := g.cfg.BanDuration
+	for i := 0; i < record.bans && duration < g.cfg.MaxBanDuration; i++ {
+		duration *= 2
+	}
+	if duration > g.cfg.MaxBanDuration {
+		duration = g.cfg.MaxBanDuration
+	}
+	record.bans++
+	record.failures = 0
+	record.bannedUntil = now.Add(duration)
+	LogInfo("🚫 Banned %s for %v after repeated authentication failures", who, duration)
+	g.logBans(now)
+}
+
+// success clears the failure counters after a successful login
+func (g *authGuard) success(ip, username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if record := g.ips[ip]; record != nil {
+		record.failures = 0
+	}
+	if record := g.users[strings.ToLower(username)]; record != nil {
+		record.failures = 0
+	}
+}
+
+// logBans writes the current ban list to the log
+func (g *authGuard) logBans(now time.Time) {
+	g.prune(g.ips, now)
+	g.prune(g.users, now)
+	active := g.activeBans(g.ips, "ip", now)
+	active = append(active, g.activeBans(g.users, "user", now)...)
+	sort.Strings(active)
+	LogStats("Active authentication bans (%d): %s", len(active), strings.Join(active, ", "))
+}
+
+func (g *authGuard) activeBans(records map[string]*failureRecord, kind string, now time.Time) []string {
+	var active []string
+	for key, record := range records {
+		if now.Before(record.bannedUntil) {
+			active = append(active, fmt.Sprintf("%s %s until %s", kind, key, record.bannedUntil.Format(time.RFC3339)))
+		}
+	}
+	return active
+}
+
+// prune forgets records that are neither banned nor recent. Records of past
+// offenders are kept for MaxBanDuration so that repeat bans escalate.
+func (g *authGuard) prune(records map[string]*failureRecord, now time.Time) {
+	for key, record := range records {
+		if now.After(record.bannedUntil) && now.Sub(record.lastFailure) > g.cfg.MaxBanDuration {
+			delete(records, key)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testAuthGuard(t *testing.T, cfg AuthGuardConfig) *authGuard {
+	t.Helper()
+	cfg.applyDefaults()
+	g, err := newAuthGuard(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestAuthGuardEscalatingDelay(t *testing.T) {
+	g := testAuthGuard(t, AuthGuardConfig{MaxFailures: 100, BaseDelay: time.Second, MaxDelay: 5 * time.Second})
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, delay := range want {
+		if got := g.failure("192.0.2.1", "alice", "POP3"); got != delay {
+			t.Errorf("failure %d: delay %v, want %v", i+1, got, delay)
+		}
+	}
+
+	// A successful login starts over
+	g.success("192.0.2.1", "alice")
+	if got := g.failure("192.0.2.1", "alice", "POP3"); got != time.Second {
+		t.Errorf("after success: delay %v, want %v", got, time.Second)
+	}
+}
+
+func TestAuthGuardBansIPAndUser(t *testing.T) {
+	g := testAuthGuard(t, AuthGuardConfig{MaxFailures: 3})
+
+	// Three addresses fail for alice: the user is banned, the addresses are not
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		g.failure(ip, "alice", "POP3")
+	}
+	if !g.banned("198.51.100.7", "Alice") {
+		t.Error("user not banned after max_failures, whatever the address and case")
+	}
+	if g.bannedIP("192.0.2.1") || g.banned("192.0.2.1", "bob") {
+		t.Error("address banned after a single failure")
+	}
+
+	// One address fails for three users: the address is banned for everyone
+	for _, user := range []string{"u1", "u2", "u3"} {
+		g.failure("203.0.113.5", user, "SMTP")
+	}
+	if !g.bannedIP("203.0.113.5") || !g.banned("203.0.113.5", "carol") {
+		t.Error("address not banned after max_failures")
+	}
+}
+
+func TestAuthGuardBanExpiresAndEscalates(t *testing.T) {
+	g := testAuthGuard(t, AuthGuardConfig{MaxFailures: 1, BanDuration: time.Minute, MaxBanDuration: 3 * time.Minute})
+	ip := "192.0.2.1"
+
+	remaining := func() time.Duration {
+		return time.Until(g.ips[ip].bannedUntil).Round(time.Minute)
+	}
+	expire := func() {
+		g.ips[ip].bannedUntil = time.Now().Add(-time.Second)
+		if g.bannedIP(ip) {
+			t.Fatal("still banned after the ban ended")
+		}
+	}
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		g.failure(ip, "alice", "POP3")
+		if !g.bannedIP(ip) {
+			t.Fatal("not banned")
+		}
+		if got := remaining(); got != want {
+			t.Errorf("ban %d: %v, want %v", g.ips[ip].bans, got, want)
+		}
+		expire()
+	}
+}
+
+func TestAuthGuardFailureWindow(t *testing.T) {
+	g := testAuthGuard(t, AuthGuardConfig{MaxFailures: 2, FailureWindow: time.Minute})
+	g.failure("192.0.2.1", "alice", "POP3")
+	g.ips["192.0.2.1"].lastFailure = time.Now().Add(-2 * time.Minute)
+	g.users["alice"].lastFailure = time.Now().Add(-2 * time.Minute)
+
+	g.failure("192.0.2.1", "alice", "POP3")
+	if g.banned("192.0.2.1", "alice") {
+		t.Error("a failure outside the window counted towards the ban")
+	}
+}
+
+func TestAuthGuardExemptions(t *testing.T) {
+	g := testAuthGuard(t, AuthGuardConfig{MaxFailures: 1, BaseDelay: time.Second, Allowlist: []string{"10.0.0.0/8"}})
+	if delay := g.failure("10.1.2.3", "alice", "POP3"); delay != 0 {
+		t.Errorf("allowlisted address delayed by %v", delay)
+	}
+	if g.banned("10.1.2.3", "alice") || len(g.users) != 0 {
+		t.Error("allowlisted address counted or banned")
+	}
+	// A user banned from elsewhere may still log in from the allowlist
+	g.failure("192.0.2.1", "alice", "POP3")
+	if !g.banned("192.0.2.1", "alice") || g.banned("10.1.2.3", "alice") {
+		t.Error("allowlist does not exempt from the user ban")
+	}
+
+	disabled := testAuthGuard(t, AuthGuardConfig{Disabled: true, MaxFailures: 1})
+	disabled.failure("192.0.2.1", "alice", "POP3")
+	if disabled.banned("192.0.2.1", "alice") {
+		t.Error("disabled guard banned a client")
+	}
+}
+
+func TestAuthGuardPrune(t *testing.T) {
+	g := testAuthGuard(t, AuthGuardConfig{MaxFailures: 10, MaxBanDuration: time.Hour})
+	now := time.Now()
+	g.ips["stale"] = &failureRecord{failures: 1, lastFailure: now.Add(-2 * time.Hour)}
+	g.ips["recent"] = &failureRecord{failures: 1, lastFailure: now.Add(-time.Minute)}
+	g.ips["banned"] = &failureRecord{lastFailure: now.Add(-2 * time.Hour), bannedUntil: now.Add(time.Hour)}
+
+	g.prune(g.ips, now)
+	if _, ok := g.ips["stale"]; ok {
+		t.Error("stale record kept")
+	}
+	for _, key := range []string{"recent", "banned"} {
+		if _, ok := g.ips[key]; !ok {
+			t.Errorf("%s record pruned", key)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// messageCache keeps fetched messages on disk, keyed by (mailbox, UIDVALIDITY, UID),
+// so that TOP followed by RETR, or a client re-downloading after an error, does not
+// fetch the same message from upstream again. A nil cache caches nothing.
+//
+// Layout: <dir>/<hash of mailbox>/<UIDVALIDITY>/<UID>
+type messageCache struct {
+	mu              sync.Mutex
+	dir             string
+	maxBytes        int64
+	maxMessageBytes int64
+	total           int64
+	entries         map[string]*cacheEntry // by file path
+	validity        map[string]uint32      // last UIDVALIDITY seen, by mailbox directory
+}
+
+type cacheEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+func newMessageCache(cfg CacheConfig) (*messageCache, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("message cache: %w", err)
+	}
+	c := &messageCache{
+		dir:             cfg.Dir,
+		maxBytes:        int64(cfg.MaxSizeMB) << 20,
+		maxMessageBytes: int64(cfg.MaxMessageSizeMB) << 20,
+		entries:         make(map[string]*cacheEntry),
+		validity:        make(map[string]uint32),
+	}
+
+	// Pick up messages cached before a restart
+	err := filepath.WalkDir(cfg.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if filepath.Ext(path) == ".tmp" {
+			os.Remove(path)
+			return nil
+		}
+		c.entries[path] = &cacheEntry{size: info.Size(), lastUsed: info.ModTime()}
+		c.total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("message cache: %w", err)
+	}
+	c.evict()
+	LogInfo("Message cache in %s: %d messages, %d MB (limit %d MB)", cfg.Dir, len(c.entries), c.total>>20, cfg.MaxSizeMB)
+	return c, nil
+}
+
+// mailboxDir returns the cache directory of a mailbox such as "user@imap.example.com:993/INBOX"
+func (c *messageCache) mailboxDir(mailbox string) string {
+	sum := sha256.Sum256([]byte(mailbox))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:16]))
+}
+
+func (c *messageCache) path(mailbox string, uidValidity uint32, uid int) string {
+	return filepath.Join(c.mailboxDir(mailbox), strconv.FormatUint(uint64(uidValidity), 10), strconv.Itoa(uid))
+}
+
+// validate drops everything cached for the mailbox under another UIDVALIDITY,
+// since its UIDs no longer identify the same messages
+func (c *messageCache) validate(mailbox string, uidValidity uint32) {
+	if c == nil || mailbox == "" {
+		return
+	}
+	mailboxDir := c.mailboxDir(mailbox)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if known, ok := c.validity[mailboxDir]; ok && known == uidValidity {
+		return
+	}
+	c.validity[mailboxDir] = uidValidity
+
+	dirs, err := os.ReadDir(mailboxDir)
+	if err != nil {
+		return
+	}
+	current := strconv.FormatUint(uint64(uidValidity), 10)
+	for _, dir := range dirs {
+		if dir.Name() == current {
+			continue
+		}
+		stale := filepath.Join(mailboxDir, dir.Name())
+		for path, entry := range c.entries {
+			if filepath.Dir(path) == stale {
+				c.total -= entry.size
+				delete(c.entries, path)
+			}
+		}
+		os.RemoveAll(stale)
+		log.Printf("[CACHE] UIDVALIDITY of %s changed to %d, dropped cached messages", mailbox, uidValidity)
+	}
+}
+
+// get returns a cached message, or nil
+func (c *messageCache) get(mailbox string, uidValidity uint32, uid int) []byte {
+	if c == nil || mailbox == "" {
+		return nil
+	}
+	path := c.path(mailbox, uidValidity, uid)
+	c.mu.Lock()
+	entry := c.entries[path]
+	if entry != nil {
+		entry.lastUsed = time.Now()
+	}
+	c.mu.Unlock()
+	if entry == nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.remove(path)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now) // keep the LRU order across restarts
+	return data
+}
+
+// size returns the exact size of a cached message
+func (c *messageCache) size(mailbox string, uidValidity uint32, uid int) (int64, bool) {
+	if c == nil || mailbox == "" {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry := c.entries[c.path(mailbox, uidValidity, uid)]; entry != nil {
+		return entry.size, true
+	}
+	return 0, false
+}
+
+// accepts reports whether a message of the given size would be cached
+func (c *messageCache) accepts(mailbox string, size int64) bool {
+	return c != nil && mailbox != "" && size <= c.maxMessageBytes
+}
+
+// put stores a message fetched from upstream; messages over the size limit are not cached
+func (c *messageCache) put(mailbox string, uidValidity uint32, uid int, data []byte) {
+	if !c.accepts(mailbox, int64(len(data))) {
+		return
+	}
+	path := c.path(mailbox, uidValidity, uid)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		LogError("Message cache: %v", err)
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		LogError("Message cache: %v", err)
+		os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		LogError("Message cache: %v", err)
+		os.Remove(tmp)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.entries[path]; old != nil {
+		c.total -= old.size
+	}
+	c.entries[path] = &cacheEntry{size: int64(len(data)), lastUsed: time.Now()}
+	c.total += int64(len(data))
+	c.evict()
+}
+
+func (c *messageCache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry := c.entries[path]; entry != nil {
+		c.total -= entry.size
+		delete(c.entries, path)
+	}
+	os.Remove(path)
+}
+
+// evict removes the least recently used messages until the cache fits max_size_mb.
+// The caller holds mu.
+func (c *messageCache) evict() {
+	if c.total <= c.maxBytes {
+		return
+	}
+	paths := make([]string, 0, len(c.entries))
+	for path := range c.entries {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return c.entries[paths[i]].lastUsed.Before(c.entries[paths[j]].lastUsed)
+	})
+	evicted := 0
+	for _, path := range paths {
+		if c.total <= c.maxBytes {
+			break
+		}
+		c.total -= c.entries[path].size
+		delete(c.entries, path)
+		os.Remove(path)
+		evicted++
+	}
+	LogDebug("Message cache: evicted %d messages, %d MB in use", evicted, c.total>>20)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+const testMailbox = "alice@imap.example.com:993/INBOX"
+
+// testCache returns an empty cache in a temporary directory, limited to
+// maxBytes in all and maxMessageBytes per message
+func testCache(t *testing.T, maxBytes, maxMessageBytes int64) *messageCache {
+	t.Helper()
+	c, err := newMessageCache(CacheConfig{Dir: t.TempDir(), MaxSizeMB: 1, MaxMessageSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.maxBytes, c.maxMessageBytes = maxBytes, maxMessageBytes
+	return c
+}
+
+func TestMessageCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := testCache(t, 250, 100)
+	message := bytes.Repeat([]byte("x"), 100)
+	c.put(testMailbox, 1, 1, message)
+	c.put(testMailbox, 1, 2, message)
+	// Using UID 1 makes UID 2 the oldest
+	time.Sleep(10 * time.Millisecond)
+	if c.get(testMailbox, 1, 1) == nil {
+		t.Fatal("UID 1 not cached")
+	}
+
+	c.put(testMailbox, 1, 3, message)
+	if c.total != 200 || len(c.entries) != 2 {
+		t.Errorf("after eviction: %d bytes in %d messages, want 200 in 2", c.total, len(c.entries))
+	}
+	if c.get(testMailbox, 1, 2) != nil {
+		t.Error("least recently used message kept")
+	}
+	if _, err := os.Stat(c.path(testMailbox, 1, 2)); !os.IsNotExist(err) {
+		t.Error("evicted message left on disk")
+	}
+	for _, uid := range []int{1, 3} {
+		if !bytes.Equal(c.get(testMailbox, 1, uid), message) {
+			t.Errorf("UID %d evicted", uid)
+		}
+	}
+}
+
+func TestMessageCacheSizeLimit(t *testing.T) {
+	c := testCache(t, 1000, 100)
+	c.put(testMailbox, 1, 1, bytes.Repeat([]byte("x"), 101))
+	c.put("", 1, 2, []byte("no mailbox"))
+	if len(c.entries) != 0 {
+		t.Error("message over the size limit or without a mailbox cached")
+	}
+
+	var disabled *messageCache
+	disabled.put(testMailbox, 1, 1, []byte("x"))
+	if disabled.get(testMailbox, 1, 1) != nil {
+		t.Error("nil cache caches")
+	}
+}
+
+func TestMessageCacheAccepts(t *testing.T) {
+	c := testCache(t, 1000, 100)
+	if !c.accepts(testMailbox, 100) || c.accepts(testMailbox, 101) {
+		t.Error("accepts does not follow max_message_size")
+	}
+	if c.accepts("", 10) {
+		t.Error("message without a mailbox accepted")
+	}
+	var disabled *messageCache
+	if disabled.accepts(testMailbox, 1) {
+		t.Error("nil cache accepts messages")
+	}
+}
+
+func TestMessageCacheUIDValidityReset(t *testing.T) {
+	c := testCache(t, 1000, 100)
+	c.validate(testMailbox, 1)
+	c.put(testMailbox, 1, 1, []byte("old message"))
+	c.put("bob@imap.example.com:993/INBOX", 1, 1, []byte("other mailbox"))
+
+	// The same UIDVALIDITY keeps the cache
+	c.validate(testMailbox, 1)
+	if c.get(testMailbox, 1, 1) == nil {
+		t.Fatal("message dropped although UIDVALIDITY did not change")
+	}
+
+	c.validate(testMailbox, 2)
+	if _, ok := c.size(testMailbox, 1, 1); ok {
+		t.Error("message of the old UIDVALIDITY still cached")
+	}
+	if _, err := os.Stat(c.path(testMailbox, 1, 1)); !os.IsNotExist(err) {
+		t.Error("message of the old UIDVALIDITY left on disk")
+	}
+	if c.get("bob@imap.example.com:993/INBOX", 1, 1) == nil {
+		t.Error("another mailbox lost its messages")
+	}
+	if c.total != int64(len("other mailbox")) {
+		t.Errorf("cache size %d after the reset", c.total)
+	}
+}
+
+func TestMessageCacheSurvivesRestart(t *testing.T) {
+	c := testCache(t, 1000, 100)
+	c.put(testMailbox, 1, 1, []byte("message"))
+	os.WriteFile(c.path(testMailbox, 1, 2)+".tmp", []byte("partial"), 0600)
+
+	reopened, err := newMessageCache(CacheConfig{Dir: c.dir, MaxSizeMB: 1, MaxMessageSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reopened.get(testMailbox, 1, 1)) != "message" {
+		t.Error("cached message lost across a restart")
+	}
+	if len(reopened.entries) != 1 {
+		t.Errorf("%d entries after a restart, want 1", len(reopened.entries))
+	}
+	if _, err := os.Stat(c.path(testMailbox, 1, 2) + ".tmp"); !os.IsNotExist(err) {
+		t.Error("partial write not removed at startup")
+	}
+}
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,6 +20,9 @@ type ServerConfig struct {
 	POP3 *MailServerConfig `yaml:"pop3,omitempty"`
 	IMAP *MailServerConfig `yaml:"imap,omitempty"`
 	SMTP *MailServerConfig `yaml:"smtp,omitempty"`
+
+	// Overrides the global upstream_proxy for this server ("type: direct" disables it)
+	UpstreamProxy *UpstreamProxyConfig `yaml:"upstream_proxy,omitempty"`
 }
 
 type MailServerConfig struct {
@@ -20,19 +31,432 @@ type MailServerConfig struct {
 	UseTLS   bool   `yaml:"use_tls"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
+
+	// TLS verification settings for this server (system roots when omitted)
+	TLS *UpstreamTLSConfig `yaml:"tls,omitempty"`
+
+	// IMAP only: when POP3 access sets \Seen upstream: "never" (default), "retr" or "dele"
+	MarkSeen string `yaml:"mark_seen,omitempty"`
+	// IMAP only: what a committed POP3 DELE does upstream: "expunge" (default),
+	// "move" to DeleteFolder, "gmail_archive" (remove the Inbox label) or "keep"
+	DeleteMode   string `yaml:"delete_mode,omitempty"`
+	DeleteFolder string `yaml:"delete_folder,omitempty"`
+	// IMAP only: folders shown to POP3 clients as one mailbox (default INBOX)
+	Folders []string `yaml:"folders,omitempty"`
+	// IMAP only: which messages of each folder POP3 clients see (all when omitted)
+	View *ViewConfig `yaml:"view,omitempty"`
+	// IMAP only: APPEND messages sent through the server's smtp block to the
+	// Sent folder, found by its \Sent attribute unless SentFolder is set
+	SaveSent   bool   `yaml:"save_sent,omitempty"`
+	SentFolder string `yaml:"sent_folder,omitempty"`
+
+	// proxy is the effective upstream proxy, resolved by LoadConfig
+	proxy *UpstreamProxyConfig
+	// tlsConfig is built from TLS by LoadConfig
+	tlsConfig *tls.Config
+}
+
+// ViewConfig limits the messages of a folder that a POP3 client sees, so huge
+// mailboxes become a bounded maildrop. Zero values do not filter.
+type ViewConfig struct {
+	MaxAgeDays  int  `yaml:"max_age_days,omitempty"` // only messages received in the last N days
+	UnseenOnly  bool `yaml:"unseen_only,omitempty"`  // only messages without \Seen
+	MaxSizeMB   int  `yaml:"max_size_mb,omitempty"`  // only messages smaller than this
+	MaxMessages int  `yaml:"max_messages,omitempty"` // at most the N newest messages per folder
+}
+
+func (v *ViewConfig) validate() error {
+	if v == nil {
+		return nil
+	}
+	if v.MaxAgeDays < 0 || v.MaxSizeMB < 0 || v.MaxMessages < 0 {
+		return fmt.Errorf("view limits must not be negative")
+	}
+	return nil
+}
+
+// UpstreamTLSConfig controls how the certificate of an upstream server is verified
+type UpstreamTLSConfig struct {
+	CAFile             string   `yaml:"ca_file,omitempty"`     // PEM bundle trusted instead of the system roots
+	PinnedSPKI         []string `yaml:"pinned_spki,omitempty"` // base64 SHA-256 of a certificate public key in the chain
+	ClientCert         string   `yaml:"client_cert,omitempty"` // PEM client certificate for servers that require one
+	ClientKey          string   `yaml:"client_key,omitempty"`
+	ServerName         string   `yaml:"server_name,omitempty"`          // SNI and verified name, if different from host
+	MinVersion         string   `yaml:"min_version,omitempty"`          // "1.0", "1.1", "1.2" (default) or "1.3"
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify,omitempty"` // lab use only: accept any certificate
+}
+
+// UpstreamProxyConfig is an outbound proxy that upstream connections are tunnelled through
+type UpstreamProxyConfig struct {
+	Type     string `yaml:"type"`    // "socks5", "http" (CONNECT) or "direct"
+	Address  string `yaml:"address"` // proxy host:port
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// ListenerConfig describes a local listener that legacy clients connect to
+type ListenerConfig struct {
+	Name     string `yaml:"name,omitempty"`
+	Protocol string `yaml:"protocol,omitempty"` // "pop3" or "smtp"; only needed in local.listeners
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	UseTLS   bool   `yaml:"use_tls"` // implicit TLS (ports 465/995), needs TLSCert/TLSKey
+
+	// TLS offered to local clients
+	StartTLS   bool   `yaml:"starttls,omitempty"`    // offer STARTTLS (SMTP) / STLS (POP3)
+	RequireTLS bool   `yaml:"require_tls,omitempty"` // refuse logins before TLS is active
+	TLSCert    string `yaml:"tls_cert,omitempty"`
+	TLSKey     string `yaml:"tls_key,omitempty"`
+
+	// Authentication and routing policy
+	RequireAuth bool     `yaml:"require_auth,omitempty"` // SMTP: no legacy mode; POP3: only local users may log in
+	Servers     []string `yaml:"servers,omitempty"`      // upstream servers reachable through this listener (empty = all)
+
+	// Client networks (CIDR or single IP) checked right after accept.
+	// Deny wins over allow; an empty allow list admits everyone not denied.
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+	// SMTP only: networks that may send without AUTH (legacy mode). Empty admits everyone.
+	LegacyAllow []string `yaml:"legacy_allow,omitempty"`
+
+	// HAProxy PROXY protocol v1/v2 from a load balancer in front of the listener.
+	// "required": every connection must start with a header (and come from ProxyTrusted, if set);
+	// "optional": connections from ProxyTrusted must send a header, others are direct clients.
+	ProxyProtocol string   `yaml:"proxy_protocol,omitempty"`
+	ProxyTrusted  []string `yaml:"proxy_trusted,omitempty"`
+}
+
+// LocalUserConfig is an account that legacy clients log in with locally.
+// Its password is checked by the proxy; the upstream credentials of Server are used upstream.
+type LocalUserConfig struct {
+	Username string      `yaml:"username"`
+	Password string      `yaml:"password"`
+	Server   string      `yaml:"server"`            // name of the ServerConfig this user reaches
+	Folders  []string    `yaml:"folders,omitempty"` // IMAP folders this user sees, overriding the server's
+	View     *ViewConfig `yaml:"view,omitempty"`    // overrides the view of the servers
+	// POP3: servers whose IMAP mailboxes are merged into one maildrop; Server
+	// defaults to the first and is used for SMTP
+	Servers []string `yaml:"servers,omitempty"`
+	Allow   []string `yaml:"allow,omitempty"` // client networks this user may log in from
+	Deny    []string `yaml:"deny,omitempty"`
 }
 
 type LocalConfig struct {
-	POP3 MailServerConfig  `yaml:"pop3"`
-	SMTP *MailServerConfig `yaml:"smtp,omitempty"`
+	POP3      ListenerConfig    `yaml:"pop3"`
+	SMTP      *ListenerConfig   `yaml:"smtp,omitempty"`
+	Listeners []ListenerConfig  `yaml:"listeners,omitempty"` // additional listeners, each with its own policy
+	Users     []LocalUserConfig `yaml:"users,omitempty"`
 	// Note: POP3 and SMTP are supported for local connections (legacy clients)
 	// IMAP is only used for upstream connections
 }
 
+// TimeoutConfig controls how long client and upstream connections may stay silent.
+// Zero values are replaced with the defaults below when the configuration is loaded.
+type TimeoutConfig struct {
+	POP3Idle                time.Duration `yaml:"pop3_idle,omitempty"`                 // RFC 1939: at least 10 minutes
+	SMTPCommand             time.Duration `yaml:"smtp_command,omitempty"`              // RFC 5321 4.5.3.2.7: at least 5 minutes
+	SMTPData                time.Duration `yaml:"smtp_data,omitempty"`                 // RFC 5321 4.5.3.2.5: 3 minutes per data block
+	UpstreamDial            time.Duration `yaml:"upstream_dial,omitempty"`             // TCP connect
+	UpstreamTLSHandshake    time.Duration `yaml:"upstream_tls_handshake,omitempty"`    // TLS and STARTTLS handshakes
+	UpstreamResponse        time.Duration `yaml:"upstream_response,omitempty"`         // any single upstream reply
+	UpstreamDataTermination time.Duration `yaml:"upstream_data_termination,omitempty"` // RFC 5321 4.5.3.2.6: reply to the final "."
+}
+
+const (
+	defaultPOP3IdleTimeout                = 10 * time.Minute
+	defaultSMTPCommandTimeout             = 5 * time.Minute
+	defaultSMTPDataTimeout                = 3 * time.Minute
+	defaultUpstreamDialTimeout            = 30 * time.Second
+	defaultUpstreamTLSHandshakeTimeout    = 30 * time.Second
+	defaultUpstreamResponseTimeout        = 5 * time.Minute
+	defaultUpstreamDataTerminationTimeout = 10 * time.Minute
+)
+
+// applyDefaults fills unset timeouts with RFC-recommended values
+func (t *TimeoutConfig) applyDefaults() {
+	setDefaultDuration(&t.POP3Idle, defaultPOP3IdleTimeout)
+	setDefaultDuration(&t.SMTPCommand, defaultSMTPCommandTimeout)
+	setDefaultDuration(&t.SMTPData, defaultSMTPDataTimeout)
+	setDefaultDuration(&t.UpstreamDial, defaultUpstreamDialTimeout)
+	setDefaultDuration(&t.UpstreamTLSHandshake, defaultUpstreamTLSHandshakeTimeout)
+	setDefaultDuration(&t.UpstreamResponse, defaultUpstreamResponseTimeout)
+	setDefaultDuration(&t.UpstreamDataTermination, defaultUpstreamDataTerminationTimeout)
+}
+
+func setDefaultDuration(d *time.Duration, def time.Duration) {
+	if *d <= 0 {
+		*d = def
+	}
+}
+
+// LimitsConfig caps how many local connections and upstream logins may exist at once.
+// Zero means unlimited.
+type LimitsConfig struct {
+	MaxConnections      int `yaml:"max_connections,omitempty"`        // all local listeners together
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip,omitempty"` // concurrent connections per client IP
+	ConnectionRatePerIP int `yaml:"connection_rate_per_ip,omitempty"` // new connections per minute per client IP
+	MaxUpstreamLogins   int `yaml:"max_upstream_logins,omitempty"`    // simultaneous logins per upstream mailbox
+}
+
+// AuthGuardConfig controls brute-force protection of POP3 PASS and SMTP AUTH.
+// Zero values are replaced with the defaults below when the configuration is loaded.
+type AuthGuardConfig struct {
+	Disabled       bool          `yaml:"disabled,omitempty"`
+	MaxFailures    int           `yaml:"max_failures,omitempty"`     // failures per IP or username before a ban
+	FailureWindow  time.Duration `yaml:"failure_window,omitempty"`   // failures older than this are forgotten
+	BaseDelay      time.Duration `yaml:"delay,omitempty"`            // delay after the first failure, doubled for each further one
+	MaxDelay       time.Duration `yaml:"max_delay,omitempty"`        // upper bound for the escalating delay
+	BanDuration    time.Duration `yaml:"ban_duration,omitempty"`     // first ban, doubled for repeat offenders
+	MaxBanDuration time.Duration `yaml:"max_ban_duration,omitempty"` // upper bound for escalating bans
+	Allowlist      []string      `yaml:"allowlist,omitempty"`        // trusted networks that are never delayed or banned
+}
+
+const (
+	defaultMaxAuthFailures    = 5
+	defaultAuthFailureWindow  = 15 * time.Minute
+	defaultAuthBaseDelay      = time.Second
+	defaultAuthMaxDelay       = 30 * time.Second
+	defaultAuthBanDuration    = 30 * time.Minute
+	defaultAuthMaxBanDuration = 24 * time.Hour
+)
+
+// applyDefaults fills unset brute-force protection settings
+func (a *AuthGuardConfig) applyDefaults() {
+	if a.MaxFailures <= 0 {
+		a.MaxFailures = defaultMaxAuthFailures
+	}
+	setDefaultDuration(&a.FailureWindow, defaultAuthFailureWindow)
+	setDefaultDuration(&a.BaseDelay, defaultAuthBaseDelay)
+	setDefaultDuration(&a.MaxDelay, defaultAuthMaxDelay)
+	setDefaultDuration(&a.BanDuration, defaultAuthBanDuration)
+	setDefaultDuration(&a.MaxBanDuration, defaultAuthMaxBanDuration)
+}
+
+// IMAPPoolConfig controls how authenticated upstream IMAP connections are kept
+// between POP3 sessions. Zero values are replaced with the defaults below.
+type IMAPPoolConfig struct {
+	Disabled          bool          `yaml:"disabled,omitempty"`
+	MaxIdlePerMailbox int           `yaml:"max_idle_per_mailbox,omitempty"` // idle connections kept per upstream mailbox
+	IdleTimeout       time.Duration `yaml:"idle_timeout,omitempty"`         // idle connections are logged out after this
+	Keepalive         time.Duration `yaml:"keepalive,omitempty"`            // NOOP interval for idle connections
+}
+
+const (
+	defaultPoolMaxIdlePerMailbox = 2
+	defaultPoolIdleTimeout       = 10 * time.Minute
+	defaultPoolKeepalive         = 4 * time.Minute
+)
+
+// applyDefaults fills unset connection pool settings
+func (p *IMAPPoolConfig) applyDefaults() {
+	if p.MaxIdlePerMailbox <= 0 {
+		p.MaxIdlePerMailbox = defaultPoolMaxIdlePerMailbox
+	}
+	setDefaultDuration(&p.IdleTimeout, defaultPoolIdleTimeout)
+	setDefaultDuration(&p.Keepalive, defaultPoolKeepalive)
+}
+
+// CacheConfig controls the on-disk cache of messages fetched from upstream.
+// The cache is disabled when Dir is empty.
+type CacheConfig struct {
+	Dir              string `yaml:"dir,omitempty"`
+	MaxSizeMB        int    `yaml:"max_size_mb,omitempty"`         // least recently used messages are evicted above this
+	MaxMessageSizeMB int    `yaml:"max_message_size_mb,omitempty"` // larger messages are not cached
+}
+
+const (
+	defaultCacheMaxSizeMB        = 512
+	defaultCacheMaxMessageSizeMB = 25
+)
+
+// applyDefaults fills unset cache limits
+func (c *CacheConfig) applyDefaults() {
+	if c.MaxSizeMB <= 0 {
+		c.MaxSizeMB = defaultCacheMaxSizeMB
+	}
+	if c.MaxMessageSizeMB <= 0 {
+		c.MaxMessageSizeMB = defaultCacheMaxMessageSizeMB
+	}
+}
+
+// JournalConfig controls the compliance journal: a copy of every message sent
+// through the SMTP listeners and every message retrieved with RETR, together
+// with its envelope. The journal is disabled when Dir is empty.
+type JournalConfig struct {
+	Dir           string `yaml:"dir,omitempty"`
+	Format        string `yaml:"format,omitempty"`         // "maildir" (default) or "mbox" (gzip-compressed)
+	Rotate        string `yaml:"rotate,omitempty"`         // new Maildir or mbox file "daily" (default) or "monthly"
+	RetentionDays int    `yaml:"retention_days,omitempty"` // older periods are deleted; 0 keeps everything
+}
+
+// validate checks the journal settings and fills their defaults
+func (j *JournalConfig) validate() error {
+	switch j.Format {
+	case "":
+		j.Format = "maildir"
+	case "maildir", "mbox":
+	default:
+		return fmt.Errorf("journal: format must be maildir or mbox")
+	}
+	switch j.Rotate {
+	case "":
+		j.Rotate = "daily"
+	case "daily", "monthly":
+	default:
+		return fmt.Errorf("journal: rotate must be daily or monthly")
+	}
+	if j.RetentionDays < 0 {
+		return fmt.Errorf("journal: retention_days cannot be negative")
+	}
+	return nil
+}
+
+// QueueConfig turns on store-and-forward for the SMTP listeners: messages are
+// accepted once they are on disk and relayed upstream in the background.
+// Relaying is synchronous when Dir is empty.
+type QueueConfig struct {
+	Dir      string        `yaml:"dir,omitempty"`
+	RetryMin time.Duration `yaml:"retry_min,omitempty"` // delay after the first failed attempt, doubled after each
+	RetryMax time.Duration `yaml:"retry_max,omitempty"` // upper bound for the retry delay
+	Expire   time.Duration `yaml:"expire,omitempty"`    // undelivered messages are bounced after this
+	BounceTo string        `yaml:"bounce_to,omitempty"` // "sender" (through upstream SMTP) or "inbox"
+}
+
+const (
+	defaultQueueRetryMin = time.Minute
+	defaultQueueRetryMax = time.Hour
+	defaultQueueExpire   = 5 * 24 * time.Hour
+)
+
+// applyDefaults fills unset queue intervals
+func (q *QueueConfig) applyDefaults() {
+	setDefaultDuration(&q.RetryMin, defaultQueueRetryMin)
+	setDefaultDuration(&q.RetryMax, defaultQueueRetryMax)
+	setDefaultDuration(&q.Expire, defaultQueueExpire)
+}
+
+// validate checks where delivery status notifications go
+func (q *QueueConfig) validate() error {
+	switch q.BounceTo {
+	case "":
+		q.BounceTo = "sender"
+	case "sender", "inbox":
+	default:
+		return fmt.Errorf("queue: bounce_to must be sender or inbox")
+	}
+	return nil
+}
+
+// WatchConfig selects the mailboxes whose INBOX is watched with IDLE (or
+// polling) between POP3 sessions, and what happens when new mail arrives
+type WatchConfig struct {
+	Servers      []string      `yaml:"servers,omitempty"`       // servers with an imap block to watch
+	PollInterval time.Duration `yaml:"poll_interval,omitempty"` // NOOP interval for servers without IDLE
+	IdleRefresh  time.Duration `yaml:"idle_refresh,omitempty"`  // IDLE is restarted after this (RFC 2177: under 29 minutes)
+	Prefetch     bool          `yaml:"prefetch,omitempty"`      // fetch new messages into the message cache
+	Webhook      string        `yaml:"webhook,omitempty"`       // URL that new-mail events are POSTed to as JSON
+	Exec         string        `yaml:"exec,omitempty"`          // command run for new-mail events
+}
+
+const (
+	defaultWatchPollInterval = 2 * time.Minute
+	defaultWatchIdleRefresh  = 25 * time.Minute
+)
+
+// applyDefaults fills unset watch intervals
+func (w *WatchConfig) applyDefaults() {
+	setDefaultDuration(&w.PollInterval, defaultWatchPollInterval)
+	setDefaultDuration(&w.IdleRefresh, defaultWatchIdleRefresh)
+}
+
+// FetchJobConfig pulls new mail from an upstream mailbox on a schedule and
+// delivers it locally, for systems that cannot speak POP3 (fetchmail mode)
+type FetchJobConfig struct {
+	Name          string         `yaml:"name,omitempty"`           // defaults to the server name
+	Server        string         `yaml:"server"`                   // ServerConfig whose imap (or pop3) mailbox is fetched
+	Folder        string         `yaml:"folder,omitempty"`         // IMAP folder, default INBOX
+	Interval      time.Duration  `yaml:"interval,omitempty"`       // default 5m
+	Deliver       DeliveryConfig `yaml:"deliver"`                  // exactly one target
+	AfterDelivery string         `yaml:"after_delivery,omitempty"` // "keep" (default), "delete" or "move" (IMAP)
+	MoveTo        string         `yaml:"move_to,omitempty"`        // folder for after_delivery: move
+	StateFile     string         `yaml:"state_file,omitempty"`     // IDs of delivered messages
+}
+
+// DeliveryConfig is the local target of a fetch job
+type DeliveryConfig struct {
+	Maildir string   `yaml:"maildir,omitempty"` // Maildir directory (new/, cur/, tmp/ are created)
+	Mbox    string   `yaml:"mbox,omitempty"`    // mbox file, appended to under flock
+	SMTP    string   `yaml:"smtp,omitempty"`    // host:port of a local SMTP server
+	LMTP    string   `yaml:"lmtp,omitempty"`    // host:port or unix socket path of an LMTP server
+	To      string   `yaml:"to,omitempty"`      // recipient for smtp and lmtp
+	Command []string `yaml:"command,omitempty"` // program and arguments that read the message on stdin
+}
+
+const (
+	defaultFetchInterval = 5 * time.Minute
+	defaultFetchStateDir = "/var/lib/proxy-mail"
+)
+
+// validate checks a fetch job and fills its defaults
+func (j *FetchJobConfig) validate(cfg *Config) error {
+	server := cfg.GetServerByName(j.Server)
+	if server == nil || (server.IMAP == nil && server.POP3 == nil) {
+		return fmt.Errorf("server %q does not exist or has no imap or pop3 settings", j.Server)
+	}
+	if j.Folder == "" {
+		j.Folder = "INBOX"
+	}
+	setDefaultDuration(&j.Interval, defaultFetchInterval)
+	if j.StateFile == "" {
+		j.StateFile = filepath.Join(defaultFetchStateDir, "fetch-"+j.Name+".json")
+	}
+
+	targets := 0
+	for _, target := range []string{j.Deliver.Maildir, j.Deliver.Mbox, j.Deliver.SMTP, j.Deliver.LMTP} {
+		if target != "" {
+			targets++
+		}
+	}
+	if len(j.Deliver.Command) > 0 {
+		targets++
+	}
+	if targets != 1 {
+		return fmt.Errorf("deliver needs exactly one of maildir, mbox, smtp, lmtp or command")
+	}
+	if (j.Deliver.SMTP != "" || j.Deliver.LMTP != "") && j.Deliver.To == "" {
+		return fmt.Errorf("deliver to smtp or lmtp needs to")
+	}
+
+	switch j.AfterDelivery {
+	case "":
+		j.AfterDelivery = "keep"
+	case "keep", "delete":
+	case "move":
+		if server.IMAP == nil || j.MoveTo == "" {
+			return fmt.Errorf("after_delivery move needs an imap server and move_to")
+		}
+	default:
+		return fmt.Errorf("after_delivery must be keep, delete or move")
+	}
+	return nil
+}
+
 type Config struct {
-	Servers  []ServerConfig `yaml:"servers"`
-	Local    LocalConfig    `yaml:"local"`
-	LogLevel string         `yaml:"log_level,omitempty"` // "info" or "debug"
+	Servers   []ServerConfig   `yaml:"servers"`
+	Local     LocalConfig      `yaml:"local"`
+	LogLevel  string           `yaml:"log_level,omitempty"` // "info" or "debug"
+	Timeouts  TimeoutConfig    `yaml:"timeouts,omitempty"`
+	Limits    LimitsConfig     `yaml:"limits,omitempty"`
+	AuthGuard AuthGuardConfig  `yaml:"auth_guard,omitempty"`
+	IMAPPool  IMAPPoolConfig   `yaml:"imap_pool,omitempty"`
+	Cache     CacheConfig      `yaml:"cache,omitempty"`
+	Journal   JournalConfig    `yaml:"journal,omitempty"`
+	Queue     QueueConfig      `yaml:"queue,omitempty"`
+	Watch     WatchConfig      `yaml:"watch,omitempty"`
+	Fetch     []FetchJobConfig `yaml:"fetch,omitempty"`
+
+	// Proxy for all upstream connections, unless a server sets its own
+	UpstreamProxy *UpstreamProxyConfig `yaml:"upstream_proxy,omitempty"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -44,9 +468,291 @@ func LoadConfig(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	cfg.Timeouts.applyDefaults()
+	cfg.AuthGuard.applyDefaults()
+	cfg.IMAPPool.applyDefaults()
+	cfg.Cache.applyDefaults()
+	cfg.Watch.applyDefaults()
+	cfg.Queue.applyDefaults()
+	if err := cfg.resolveUpstreamProxies(); err != nil {
+		return nil, err
+	}
+	if err := cfg.loadUpstreamTLS(); err != nil {
+		return nil, err
+	}
+	for _, server := range cfg.Servers {
+		if server.IMAP == nil {
+			continue
+		}
+		if err := server.IMAP.View.validate(); err != nil {
+			return nil, fmt.Errorf("server %q: %w", server.Name, err)
+		}
+		switch server.IMAP.MarkSeen {
+		case "":
+			server.IMAP.MarkSeen = "never"
+		case "never", "retr", "dele":
+		default:
+			return nil, fmt.Errorf("server %q: mark_seen must be never, retr or dele", server.Name)
+		}
+		switch server.IMAP.DeleteMode {
+		case "":
+			server.IMAP.DeleteMode = "expunge"
+		case "expunge", "gmail_archive", "keep":
+		case "move":
+			if server.IMAP.DeleteFolder == "" {
+				return nil, fmt.Errorf("server %q: delete_mode move needs delete_folder", server.Name)
+			}
+		default:
+			return nil, fmt.Errorf("server %q: delete_mode must be expunge, move, gmail_archive or keep", server.Name)
+		}
+		if server.IMAP.SaveSent && server.SMTP == nil {
+			return nil, fmt.Errorf("server %q: save_sent needs an smtp block", server.Name)
+		}
+	}
+	if err := cfg.Journal.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Queue.validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Watch.Servers) > 0 && cfg.Limits.MaxUpstreamLogins == 1 {
+		// The watch holds the only login, and POP3 clients could never log in
+		return nil, fmt.Errorf("watch: needs limits.max_upstream_logins of at least 2, the watch holds one login")
+	}
+	for _, name := range cfg.Watch.Servers {
+		server := cfg.GetServerByName(name)
+		if server == nil || server.IMAP == nil {
+			return nil, fmt.Errorf("watch: server %q does not exist or has no imap settings", name)
+		}
+	}
+	if cfg.Watch.Webhook != "" {
+		if u, err := url.Parse(cfg.Watch.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("watch: webhook must be an http or https URL")
+		}
+	}
+	names := make(map[string]bool)
+	for i := range cfg.Fetch {
+		job := &cfg.Fetch[i]
+		if job.Name == "" {
+			job.Name = job.Server
+		}
+		if err := job.validate(&cfg); err != nil {
+			return nil, fmt.Errorf("fetch job %q: %w", job.Name, err)
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("fetch job %q: name used twice", job.Name)
+		}
+		names[job.Name] = true
+	}
+	for i := range cfg.Local.Users {
+		user := &cfg.Local.Users[i]
+		if err := user.View.validate(); err != nil {
+			return nil, fmt.Errorf("local user %q: %w", user.Username, err)
+		}
+		if user.Server == "" && len(user.Servers) > 0 {
+			user.Server = user.Servers[0]
+		}
+		if cfg.GetServerByName(user.Server) == nil {
+			return nil, fmt.Errorf("local user %q refers to unknown server %q", user.Username, user.Server)
+		}
+		for _, name := range user.Servers {
+			server := cfg.GetServerByName(name)
+			if server == nil {
+				return nil, fmt.Errorf("local user %q refers to unknown server %q", user.Username, name)
+			}
+			if len(user.Servers) > 1 && server.IMAP == nil {
+				return nil, fmt.Errorf("local user %q: server %q has no imap settings to merge", user.Username, name)
+			}
+		}
+	}
+	for _, listener := range cfg.Local.AllListeners() {
+		if listener.Protocol != "pop3" && listener.Protocol != "smtp" {
+			return nil, fmt.Errorf("listener %q: protocol must be pop3 or smtp", listener.Name)
+		}
+		switch listener.ProxyProtocol {
+		case "", "off":
+		case "optional", "required":
+			if len(listener.ProxyTrusted) == 0 {
+				return nil, fmt.Errorf("listener %q: proxy_protocol %s needs proxy_trusted", listener.Name, listener.ProxyProtocol)
+			}
+		default:
+			return nil, fmt.Errorf("listener %q: proxy_protocol must be off, optional or required", listener.Name)
+		}
+		if (listener.UseTLS || listener.StartTLS) && (listener.TLSCert == "" || listener.TLSKey == "") {
+			return nil, fmt.Errorf("listener %q: use_tls and starttls need tls_cert and tls_key", listener.Name)
+		}
+		for _, name := range listener.Servers {
+			if cfg.GetServerByName(name) == nil {
+				return nil, fmt.Errorf("listener %q refers to unknown server %q", listener.Name, name)
+			}
+		}
+	}
 	return &cfg, nil
 }
 
+// resolveUpstreamProxies validates the upstream_proxy settings and records the
+// proxy each upstream mailbox is dialled through
+func (c *Config) resolveUpstreamProxies() error {
+	if err := c.UpstreamProxy.validate(); err != nil {
+		return fmt.Errorf("upstream_proxy: %w", err)
+	}
+	for i := range c.Servers {
+		server := &c.Servers[i]
+		if err := server.UpstreamProxy.validate(); err != nil {
+			return fmt.Errorf("server %q upstream_proxy: %w", server.Name, err)
+		}
+		proxy := c.UpstreamProxy
+		if server.UpstreamProxy != nil {
+			proxy = server.UpstreamProxy
+		}
+		if proxy != nil && proxy.Type == "direct" {
+			proxy = nil
+		}
+		for _, mail := range []*MailServerConfig{server.POP3, server.IMAP, server.SMTP} {
+			if mail != nil {
+				mail.proxy = proxy
+			}
+		}
+	}
+	return nil
+}
+
+// loadUpstreamTLS builds the TLS client configuration of every upstream mailbox,
+// so certificate and CA files are checked at startup
+func (c *Config) loadUpstreamTLS() error {
+	for _, server := range c.Servers {
+		for _, mail := range []*MailServerConfig{server.POP3, server.IMAP, server.SMTP} {
+			if mail == nil {
+				continue
+			}
+			tlsConfig, err := upstreamTLSConfig(mail)
+			if err != nil {
+				return fmt.Errorf("server %q (%s) tls: %w", server.Name, upstreamAddr(mail), err)
+			}
+			mail.tlsConfig = tlsConfig
+		}
+	}
+	return nil
+}
+
+func (p *UpstreamProxyConfig) validate() error {
+	if p == nil {
+		return nil
+	}
+	p.Type = strings.ToLower(p.Type)
+	switch p.Type {
+	case "direct":
+		return nil
+	case "socks5", "http":
+	default:
+		return fmt.Errorf("type must be socks5, http or direct, got %q", p.Type)
+	}
+	if _, _, err := net.SplitHostPort(p.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %w", p.Address, err)
+	}
+	if p.Type == "socks5" && (len(p.Username) > 255 || len(p.Password) > 255) {
+		return fmt.Errorf("SOCKS5 username and password must not exceed 255 bytes")
+	}
+	return nil
+}
+
+// AllListeners returns every configured local listener: the classic pop3/smtp
+// entries (when they have a port) followed by local.listeners
+func (l *LocalConfig) AllListeners() []ListenerConfig {
+	var listeners []ListenerConfig
+	if l.POP3.Port > 0 {
+		pop3 := l.POP3
+		pop3.Protocol = "pop3"
+		listeners = append(listeners, pop3)
+	}
+	if l.SMTP != nil && l.SMTP.Port > 0 {
+		smtp := *l.SMTP
+		smtp.Protocol = "smtp"
+		listeners = append(listeners, smtp)
+	}
+	listeners = append(listeners, l.Listeners...)
+	for i := range listeners {
+		listeners[i].Protocol = strings.ToLower(listeners[i].Protocol)
+		if listeners[i].Name == "" {
+			listeners[i].Name = fmt.Sprintf("%s:%d", listeners[i].Protocol, listeners[i].Port)
+		}
+	}
+	return listeners
+}
+
+// MaildropServers returns the servers whose mailboxes the user sees over POP3
+func (u *LocalUserConfig) MaildropServers() []string {
+	if len(u.Servers) > 0 {
+		return u.Servers
+	}
+	return []string{u.Server}
+}
+
+// AllowsServer reports whether the listener may route clients to the named upstream server
+func (l *ListenerConfig) AllowsServer(name string) bool {
+	if len(l.Servers) == 0 {
+		return true
+	}
+	for _, allowed := range l.Servers {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetServerByName returns the server with the given name
+func (c *Config) GetServerByName(name string) *ServerConfig {
+	for i := range c.Servers {
+		if c.Servers[i].Name == name {
+			return &c.Servers[i]
+		}
+	}
+	return nil
+}
+
+// FindLocalUser returns the local user with the given username
+// changedSections lists the top-level sections other than log_level in which
+// next differs from c
+func (c *Config) changedSections(next *Config) []string {
+	sections := []struct {
+		name        string
+		old, latest any
+	}{
+		{"servers", c.Servers, next.Servers},
+		{"local", c.Local, next.Local},
+		{"timeouts", c.Timeouts, next.Timeouts},
+		{"limits", c.Limits, next.Limits},
+		{"auth_guard", c.AuthGuard, next.AuthGuard},
+		{"imap_pool", c.IMAPPool, next.IMAPPool},
+		{"cache", c.Cache, next.Cache},
+		{"journal", c.Journal, next.Journal},
+		{"queue", c.Queue, next.Queue},
+		{"watch", c.Watch, next.Watch},
+		{"fetch", c.Fetch, next.Fetch},
+		{"upstream_proxy", c.UpstreamProxy, next.UpstreamProxy},
+	}
+	var changed []string
+	for _, section := range sections {
+		// Compared as YAML, which leaves out state derived at load time
+		old, errOld := yaml.Marshal(section.old)
+		latest, errLatest := yaml.Marshal(section.latest)
+		if errOld != nil || errLatest != nil || !bytes.Equal(old, latest) {
+			changed = append(changed, section.name)
+		}
+	}
+	return changed
+}
+
+func (c *Config) FindLocalUser(username string) *LocalUserConfig {
+	for i := range c.Local.Users {
+		if strings.EqualFold(c.Local.Users[i].Username, username) {
+			return &c.Local.Users[i]
+		}
+	}
+	return nil
+}
+
 // GetServerByProtocol returns the first server that supports the given protocol
 func (c *Config) GetServerByProtocol(protocol string) *ServerConfig {
 	for _, server := range c.Servers {
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// deliveryTimeout bounds one local delivery
+const deliveryTimeout = 2 * time.Minute
+
+// maildirCounter makes Maildir file names unique within one second and process
+var maildirCounter atomic.Int64
+
+// deliverMessage hands a fetched message to the local target of a fetch job
+func deliverMessage(target DeliveryConfig, data []byte) error {
+	switch {
+	case target.Maildir != "":
+		return deliverMaildir(target.Maildir, data)
+	case target.Mbox != "":
+		return deliverMbox(target.Mbox, data)
+	case target.SMTP != "":
+		return deliverSMTP("tcp", target.SMTP, "EHLO", target.To, data)
+	case target.LMTP != "":
+		network := "tcp"
+		if strings.HasPrefix(target.LMTP, "/") {
+			network = "unix"
+		}
+		return deliverSMTP(network, target.LMTP, "LHLO", target.To, data)
+	default:
+		return deliverCommand(target.Command, data)
+	}
+}
+
+// unixLineEndings converts CRLF to LF, as Maildir, mbox and delivery programs expect
+func unixLineEndings(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+}
+
+// deliverMaildir stores the message in new/ under a unique name
+func deliverMaildir(dir string, data []byte) error {
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), maildirCounter.Add(1), maildirHostname())
+	return writeMaildir(dir, "new", name, data, time.Time{})
+}
+
+// maildirHostname returns the host name for Maildir file names, with / and :
+// encoded as the Maildir specification asks
+func maildirHostname() string {
+	hostname, _ := os.Hostname()
+	return strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+}
+
+// writeMaildir writes a message to tmp/ and moves it to sub/ (new or cur), so
+// readers never see a partial message. A non-zero mtime is set on the file.
+func writeMaildir(dir, sub, name string, data []byte, mtime time.Time) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	tmp := filepath.Join(dir, "tmp", name)
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(unixLineEndings(data))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !mtime.IsZero() {
+		err = os.Chtimes(tmp, mtime, mtime)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, sub, name))
+}
+
+// mboxFromLine matches lines that need quoting in mboxrd format
+var mboxFromLine = regexp.MustCompile(`(?m)^(>*From )`)
+
+// deliverMbox appends the message to an mbox file
+func deliverMbox(path string, data []byte) error {
+	return appendMbox(path, time.Now(), data)
+}
+
+// appendMbox appends a message in mboxrd format under an exclusive flock, with
+// date in its From_ line
+func appendMbox(path string, date time.Time, data []byte) error {
+	return appendLocked(path, mboxEntry(date, data))
+}
+
+// mboxEntry formats a message as one mboxrd entry: From_ line, quoted From
+// lines, LF line endings and a blank line at the end
+func mboxEntry(date time.Time, data []byte) []byte {
+	body := mboxFromLine.ReplaceAll(unixLineEndings(data), []byte(">$1"))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From MAILER-DAEMON %s\n", date.UTC().Format(time.ANSIC))
+	buf.Write(body)
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// deliverSMTP sends the message to a local SMTP (EHLO) or LMTP (LHLO) server
+// with a null envelope sender
+func deliverSMTP(network, addr, hello, to string, data []byte) error {
+	conn, err := net.DialTimeout(network, addr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(deliveryTimeout))
+	text := textproto.NewConn(conn)
+
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return fmt.Errorf("greeting: %w", err)
+	}
+	for _, step := range []struct {
+		cmd  string
+		code int
+	}{
+		{hello + " proxy-mail", 250},
+		{"MAIL FROM:<>", 250},
+		{"RCPT TO:<" + to + ">", 250},
+		{"DATA", 354},
+	} {
+		if err := text.PrintfLine("%s", step.cmd); err != nil {
+			return err
+		}
+		if _, _, err := text.ReadResponse(step.code); err != nil {
+			return fmt.Errorf("%s: %w", strings.Fields(step.cmd)[0], err)
+		}
+	}
+
+	// The POP3 message encoding is the SMTP DATA encoding: CRLF and dot-stuffing
+	if err := writeMessage(conn, data, -1); err != nil {
+		return err
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	// The message is accepted; a failing QUIT does not change that
+	if text.PrintfLine("QUIT") == nil {
+		text.ReadResponse(221)
+	}
+	return nil
+}
+
+// deliverCommand runs a delivery program with the message on stdin
+func deliverCommand(command []string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(unixLineEndings(data))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", command[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dsnOptions are the DSN parameters (RFC 3461) a client gave with MAIL and
+// RCPT, kept with a queued message
+type dsnOptions struct {
+	Ret    string            `json:"ret,omitempty"`    // FULL or HDRS
+	EnvID  string            `json:"envid,omitempty"`  // xtext as received
+	Notify map[string]string `json:"notify,omitempty"` // NOTIFY by recipient
+	ORcpt  map[string]string `json:"orcpt,omitempty"`  // ORCPT by recipient, xtext as received
+}
+
+// DSN actions (RFC 3464 2.3.3)
+const (
+	dsnFailed  = "failed"
+	dsnDelayed = "delayed"
+	dsnRelayed = "relayed"
+)
+
+// wants reports whether the sender asked to be notified about event
+// (SUCCESS, FAILURE or DELAY) for rcpt. Without NOTIFY only failures are
+// reported, as most MTAs do.
+func (d *dsnOptions) wants(rcpt, event string) bool {
+	notify := d.Notify[rcpt]
+	if notify == "" {
+		return event == "FAILURE"
+	}
+	for _, value := range strings.Split(notify, ",") {
+		if value == event {
+			return true
+		}
+	}
+	return false
+}
+
+// mailParams returns the RET and ENVID parameters of a MAIL command
+func mailParams(line string) (ret, envid string, err error) {
+	for name, value := range smtpParams(line, "FROM:") {
+		switch name {
+		case "RET":
+			ret = strings.ToUpper(value)
+			if ret != "FULL" && ret != "HDRS" {
+				return "", "", fmt.Errorf("RET must be FULL or HDRS")
+			}
+		case "ENVID":
+			envid = value
+		}
+	}
+	return ret, envid, nil
+}
+
+// rcptParams returns the NOTIFY and ORCPT parameters of a RCPT command
+func rcptParams(line string) (notify, orcpt string, err error) {
+	for name, value := range smtpParams(line, "TO:") {
+		switch name {
+		case "NOTIFY":
+			notify = strings.ToUpper(value)
+			if !validNotify(notify) {
+				return "", "", fmt.Errorf("NOTIFY must be NEVER or a list of SUCCESS, FAILURE and DELAY")
+			}
+		case "ORCPT":
+			orcpt = value
+		}
+	}
+	return notify, orcpt, nil
+}
+
+// validNotify checks a NOTIFY value: NEVER, or any of SUCCESS, FAILURE and DELAY
+func validNotify(notify string) bool {
+	if notify == "NEVER" {
+		return true
+	}
+	for _, event := range strings.Split(notify, ",") {
+		if event != "SUCCESS" && event != "FAILURE" && event != "DELAY" {
+			return false
+		}
+	}
+	return true
+}
+
+// smtpParams returns the ESMTP parameters after the address of a MAIL or
+// RCPT command, by upper-case name
+func smtpParams(line, keyword string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Fields(line[paramsStart(line, keyword):]) {
+		name, value, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(name)] = value
+	}
+	return params
+}
+
+// stripDSNParams removes the DSN parameters from a MAIL or RCPT command, for
+// upstream servers without the DSN extension
+func stripDSNParams(line, keyword string) string {
+	start := paramsStart(line, keyword)
+	kept := []string{line[:start]}
+	for _, param := range strings.Fields(line[start:]) {
+		name, _, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(name) {
+		case "RET", "ENVID", "NOTIFY", "ORCPT":
+		default:
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// paramsStart returns where the parameters begin in a MAIL or RCPT command
+func paramsStart(line, keyword string) int {
+	start := strings.Index(strings.ToUpper(line), keyword)
+	if start == -1 {
+		return len(line)
+	}
+	start += len(keyword)
+	for start < len(line) && line[start] == ' ' {
+		start++
+	}
+	end := strings.IndexByte(line[start:], ' ')
+	if strings.HasPrefix(line[start:], "<") {
+		end = strings.IndexByte(line[start:], '>') + 1
+	}
+	if end <= 0 {
+		return len(line)
+	}
+	return start + end
+}
+
+// xtextDecode decodes the "+XX" escapes of an xtext value (RFC 3461 4)
+func xtextDecode(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				out.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+// enhancedStatus returns the RFC 3463 status code of an SMTP reply, or one
+// derived from the reply code when the server sent none
+func enhancedStatus(st deliveryStatus) string {
+	fields := strings.Fields(st.Reply)
+	if len(fields) > 1 && st.Code > 0 {
+		parts := strings.Split(fields[1], ".")
+		if len(parts) == 3 && parts[0] == strconv.Itoa(st.Code/100) {
+			return fields[1]
+		}
+	}
+	switch {
+	case st.delivered():
+		return "2.0.0"
+	case st.permanent():
+		return "5.0.0"
+	case st.Code >= 400:
+		return "4.0.0"
+	}
+	return "4.4.1" // no answer from host
+}
+
+// action is the DSN action for a reply to the client that is still connected
+func (st deliveryStatus) action() string {
+	switch {
+	case st.delivered():
+		return "delivered"
+	case st.permanent():
+		return dsnFailed
+	}
+	return dsnDelayed
+}
+
+// replyStatus makes a deliveryStatus from a single-line SMTP reply
+func replyStatus(rcpt, reply string) deliveryStatus {
+	code, _ := strconv.Atoi(strings.SplitN(reply, " ", 2)[0])
+	return deliveryStatus{Rcpt: rcpt, Code: code, Reply: reply}
+}
+
+// dsnStatus returns the status code reported with action. A recipient that
+// failed after temporary errors failed because the queue expired (5.4.7).
+func dsnStatus(action string, st deliveryStatus) string {
+	status := enhancedStatus(st)
+	if action == dsnFailed && !st.permanent() {
+		return "5.4.7"
+	}
+	return status
+}
+
+// logDeliveryStatus writes one step of the delivery status trail of a
+// message; id is the queue ID, or "direct" for messages relayed while the
+// client waits
+func logDeliveryStatus(id, rcpt, action string, st deliveryStatus) {
+	log.Printf("[DSN] %s <%s>: %s (%s) %s", id, rcpt, action, dsnStatus(action, st), st.Reply)
+}
+
+// buildDSN builds a multipart/report delivery status notification (RFC 3464)
+// about the given recipients of a queued message. Failure reports return the
+// message or its headers as asked with RET; other reports return the headers.
+func (q *outboundQueue) buildDSN(msg *queuedMessage, server *ServerConfig, action string, statuses []deliveryStatus, original []byte) []byte {
+	now := time.Now()
+	host := maildirHostname()
+	boundary := fmt.Sprintf("%s.%d/%s", msg.ID, now.Unix(), host)
+
+	subject := "Undelivered Mail Returned to Sender"
+	intro := "Your message could not be delivered to the following recipients."
+	switch action {
+	case dsnDelayed:
+		subject = "Delayed Mail (still being retried)"
+		intro = fmt.Sprintf("Your message has not been delivered yet to the following recipients.\r\n"+
+			"Delivery will be retried until %s.", msg.Received.Add(q.cfg.Expire).Format(time.RFC1123Z))
+	case dsnRelayed:
+		subject = "Successful Mail Delivery Report"
+		intro = "Your message was relayed to the following recipients. The next mail server\r\n" +
+			"does not send delivery notifications, so you will not get further reports."
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: Mail Delivery System <%s>\r\n", server.SMTP.Username)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", msg.From)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s.%d.dsn@%s>\r\n", msg.ID, now.UnixNano(), host)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "This is a MIME-encapsulated message.\r\n\r\n")
+
+	fmt.Fprintf(&buf, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "This is the mail system at %s.\r\n\r\n%s\r\n\r\n", host, intro)
+	for _, st := range statuses {
+		fmt.Fprintf(&buf, "<%s>: %s\r\n", st.Rcpt, st.Reply)
+	}
+
+	fmt.Fprintf(&buf, "\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "Reporting-MTA: dns; %s\r\n", host)
+	if msg.EnvID != "" {
+		fmt.Fprintf(&buf, "Original-Envelope-Id: %s\r\n", xtextDecode(msg.EnvID))
+	}
+	fmt.Fprintf(&buf, "Arrival-Date: %s\r\n", msg.Received.Format(time.RFC1123Z))
+	for _, st := range statuses {
+		fmt.Fprintf(&buf, "\r\nFinal-Recipient: rfc822; %s\r\n", st.Rcpt)
+		if orcpt := msg.ORcpt[st.Rcpt]; orcpt != "" {
+			addrType, addr, _ := strings.Cut(xtextDecode(orcpt), ";")
+			fmt.Fprintf(&buf, "Original-Recipient: %s; %s\r\n", addrType, addr)
+		}
+		fmt.Fprintf(&buf, "Action: %s\r\n", action)
+		fmt.Fprintf(&buf, "Status: %s\r\n", dsnStatus(action, st))
+		fmt.Fprintf(&buf, "Remote-MTA: dns; %s\r\n", server.SMTP.Host)
+		if st.Code > 0 {
+			fmt.Fprintf(&buf, "Diagnostic-Code: smtp; %s\r\n", strings.ReplaceAll(st.Reply, "\n", " "))
+		}
+		fmt.Fprintf(&buf, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+		if action == dsnDelayed {
+			fmt.Fprintf(&buf, "Will-Retry-Until: %s\r\n", msg.Received.Add(q.cfg.Expire).Format(time.RFC1123Z))
+		}
+	}
+
+	if action == dsnFailed && msg.Ret == "FULL" {
+		fmt.Fprintf(&buf, "\r\n--%s\r\nContent-Type: message/rfc822\r\n\r\n", boundary)
+		buf.Write(original)
+		if !bytes.HasSuffix(original, []byte("\r\n")) {
+			buf.WriteString("\r\n")
+		}
+	} else {
+		headers := original
+		if end := bytes.Index(original, []byte("\r\n\r\n")); end >= 0 {
+			headers = original[:end+2]
+		}
+		fmt.Fprintf(&buf, "\r\n--%s\r\nContent-Type: message/rfc822-headers\r\n\r\n", boundary)
+		buf.Write(headers)
+	}
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXtextDecode(t *testing.T) {
+	tests := map[string]string{
+		"":                           "",
+		"QQ314159":                   "QQ314159",
+		"rfc822;bob+2Bsales@example": "rfc822;bob+sales@example",
+		"a+3Db+20c":                  "a=b c",
+		"+2b":                        "+", // lower-case hex is accepted too
+		"trailing+":                  "trailing+",
+		"short+4":                    "short+4",
+		"bad+ZZhex":                  "bad+ZZhex",
+		"+2B+2B":                     "++",
+	}
+	for in, want := range tests {
+		if got := xtextDecode(in); got != want {
+			t.Errorf("xtextDecode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMailParams(t *testing.T) {
+	ret, envid, err := mailParams("MAIL FROM:<alice@example.com> SIZE=100 ret=hdrs ENVID=QQ+2B1 BODY=8BITMIME")
+	if err != nil || ret != "HDRS" || envid != "QQ+2B1" {
+		t.Errorf("got %q, %q, %v", ret, envid, err)
+	}
+	// An address with spaces must not be taken for parameters
+	if ret, envid, err = mailParams(`MAIL FROM:<"a RET=FULL"@example.com>`); err != nil || ret != "" || envid != "" {
+		t.Errorf("quoted address: got %q, %q, %v", ret, envid, err)
+	}
+	if ret, _, err = mailParams("MAIL FROM:<> RET=FULL"); err != nil || ret != "FULL" {
+		t.Errorf("null sender: got %q, %v", ret, err)
+	}
+	if _, _, err := mailParams("MAIL FROM:<alice@example.com> RET=BODY"); err == nil {
+		t.Error("RET=BODY accepted")
+	}
+}
+
+func TestRcptParams(t *testing.T) {
+	for _, tc := range []struct {
+		line          string
+		notify, orcpt string
+		valid         bool
+	}{
+		{"RCPT TO:<bob@example.com>", "", "", true},
+		{"RCPT TO:<bob@example.com> NOTIFY=never", "NEVER", "", true},
+		{"RCPT TO:<bob@example.com> NOTIFY=SUCCESS,DELAY ORCPT=rfc822;bob@example.com", "SUCCESS,DELAY", "rfc822;bob@example.com", true},
+		{"RCPT TO: <bob@example.com> NOTIFY=FAILURE", "FAILURE", "", true},
+		{"RCPT TO:<bob@example.com> NOTIFY=NEVER,FAILURE", "", "", false},
+		{"RCPT TO:<bob@example.com> NOTIFY=SOMETIMES", "", "", false},
+		{"RCPT TO:<bob@example.com> NOTIFY=", "", "", false},
+	} {
+		notify, orcpt, err := rcptParams(tc.line)
+		if (err == nil) != tc.valid || notify != tc.notify || orcpt != tc.orcpt {
+			t.Errorf("%s: got %q, %q, %v", tc.line, notify, orcpt, err)
+		}
+	}
+}
+
+func TestStripDSNParams(t *testing.T) {
+	got := stripDSNParams("MAIL FROM:<alice@example.com> RET=FULL SIZE=10 ENVID=x", "FROM:")
+	if got != "MAIL FROM:<alice@example.com> SIZE=10" {
+		t.Errorf("MAIL: %q", got)
+	}
+	got = stripDSNParams("RCPT TO:<bob@example.com> NOTIFY=DELAY ORCPT=rfc822;bob@example.com", "TO:")
+	if got != "RCPT TO:<bob@example.com>" {
+		t.Errorf("RCPT: %q", got)
+	}
+}
+
+// deliveryStatusFields returns the per-recipient fields of the
+// message/delivery-status part of a report, one map per recipient
+func deliveryStatusFields(t *testing.T, report []byte) []textproto.MIMEHeader {
+	t.Helper()
+	_, part, ok := bytes.Cut(report, []byte("Content-Type: message/delivery-status\r\n\r\n"))
+	if !ok {
+		t.Fatalf("no delivery-status part in\n%s", report)
+	}
+	part, _, _ = bytes.Cut(part, []byte("\r\n--"))
+	var fields []textproto.MIMEHeader
+	for _, block := range strings.Split(string(part), "\r\n\r\n")[1:] {
+		header := textproto.MIMEHeader{}
+		for _, line := range strings.Split(block, "\r\n") {
+			if name, value, ok := strings.Cut(line, ": "); ok {
+				header.Add(name, value)
+			}
+		}
+		fields = append(fields, header)
+	}
+	return fields
+}
+
+func TestBuildDSN(t *testing.T) {
+	q := testQueue(t, QueueConfig{Expire: 48 * time.Hour})
+	server := &ServerConfig{Name: "a", SMTP: &MailServerConfig{Host: "smtp.example.com", Username: "alice@example.com"}}
+	received := time.Date(2024, time.March, 1, 9, 0, 0, 0, time.UTC)
+	msg := &queuedMessage{
+		ID: "0123ABCD", From: "alice@example.com", Received: received,
+		dsnOptions: dsnOptions{Ret: "FULL", EnvID: "QQ+2B1", ORcpt: map[string]string{"bob@example.com": "rfc822;Bob+2Bx@example.com"}},
+	}
+	original := []byte("Subject: hello\r\n\r\nsecret body\r\n")
+
+	tests := []struct {
+		action      string
+		status      deliveryStatus
+		wantStatus  string
+		wantSubject string
+		fullMessage bool
+	}{
+		{dsnDelayed, deliveryStatus{"bob@example.com", 451, "451 4.3.0 Try again later"}, "4.3.0", "Delayed Mail", false},
+		{dsnFailed, deliveryStatus{"bob@example.com", 550, "550 5.1.1 No such user"}, "5.1.1", "Undelivered Mail", true},
+		{dsnFailed, deliveryStatus{"bob@example.com", 451, "451 4.3.0 Try again later"}, "5.4.7", "Undelivered Mail", true}, // expired
+		{dsnFailed, deliveryStatus{"bob@example.com", 0, "failed to connect"}, "5.4.7", "Undelivered Mail", true},
+		{dsnRelayed, deliveryStatus{"bob@example.com", 250, "250 Ok"}, "2.0.0", "Successful Mail", false},
+	}
+	for _, tt := range tests {
+		report := q.buildDSN(msg, server, tt.action, []deliveryStatus{tt.status}, original)
+
+		if !bytes.Contains(report, []byte("\r\nSubject: "+tt.wantSubject)) {
+			t.Errorf("%s %d: subject is not %q", tt.action, tt.status.Code, tt.wantSubject)
+		}
+		if !bytes.Contains(report, []byte("\r\nOriginal-Envelope-Id: QQ+1\r\n")) {
+			t.Errorf("%s %d: ENVID not decoded", tt.action, tt.status.Code)
+		}
+		fields := deliveryStatusFields(t, report)
+		if len(fields) != 1 {
+			t.Fatalf("%s %d: %d recipients reported", tt.action, tt.status.Code, len(fields))
+		}
+		f := fields[0]
+		if f.Get("Action") != tt.action || f.Get("Status") != tt.wantStatus {
+			t.Errorf("%s %d: Action %q, Status %q, want %s (%s)", tt.action, tt.status.Code, f.Get("Action"), f.Get("Status"), tt.action, tt.wantStatus)
+		}
+		if f.Get("Final-Recipient") != "rfc822; bob@example.com" || f.Get("Original-Recipient") != "rfc822; Bob+x@example.com" {
+			t.Errorf("%s %d: recipients %q, %q", tt.action, tt.status.Code, f.Get("Final-Recipient"), f.Get("Original-Recipient"))
+		}
+		if f.Get("Remote-MTA") != "dns; smtp.example.com" {
+			t.Errorf("Remote-MTA %q", f.Get("Remote-MTA"))
+		}
+		if diag := f.Get("Diagnostic-Code"); (diag != "") != (tt.status.Code > 0) || tt.status.Code > 0 && diag != "smtp; "+tt.status.Reply {
+			t.Errorf("%s %d: Diagnostic-Code %q", tt.action, tt.status.Code, diag)
+		}
+		if until := f.Get("Will-Retry-Until"); (until != "") != (tt.action == dsnDelayed) ||
+			until != "" && until != received.Add(48*time.Hour).Format(time.RFC1123Z) {
+			t.Errorf("%s %d: Will-Retry-Until %q", tt.action, tt.status.Code, until)
+		}
+		if full := bytes.Contains(report, []byte("secret body")); full != tt.fullMessage {
+			t.Errorf("%s %d: message returned %v, want %v", tt.action, tt.status.Code, full, tt.fullMessage)
+		}
+	}
+}
+
+func TestDSNWants(t *testing.T) {
+	d := &dsnOptions{Notify: map[string]string{"a": "SUCCESS,DELAY", "b": "NEVER"}}
+	for _, tc := range []struct {
+		rcpt, event string
+		want        bool
+	}{
+		{"a", "SUCCESS", true}, {"a", "DELAY", true}, {"a", "FAILURE", false},
+		{"b", "FAILURE", false}, {"b", "DELAY", false},
+		{"c", "FAILURE", true}, {"c", "DELAY", false}, {"c", "SUCCESS", false},
+	} {
+		if got := d.wants(tc.rcpt, tc.event); got != tc.want {
+			t.Errorf("wants(%s, %s) = %v", tc.rcpt, tc.event, got)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportStateFile is kept in the output directory and records how far each
+// folder has been exported, so the next run continues from there
+const exportStateFile = ".proxy-mail-export.json"
+
+// exportState is the content of exportStateFile
+type exportState struct {
+	Server  string                        `json:"server"`
+	Format  string                        `json:"format"`
+	Folders map[string]*exportFolderState `json:"folders"`
+}
+
+type exportFolderState struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	LastUID     int    `json:"last_uid"` // highest exported UID
+}
+
+// exportOptions are the flags of the export command
+type exportOptions struct {
+	server  string
+	format  string
+	since   time.Time
+	out     string
+	folders []string // all selectable folders when empty
+}
+
+// runExport implements `proxy-mail export`: it copies whole IMAP folders of an
+// upstream mailbox to Maildir or mbox, continuing where the last run stopped
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := flags.String("config", "config.yaml", "Path to configuration file")
+	server := flags.String("server", "", "Server whose imap mailbox is exported (required)")
+	format := flags.String("format", "maildir", "Output format: maildir or mbox")
+	since := flags.String("since", "", "Only export messages received on or after this date (YYYY-MM-DD)")
+	out := flags.String("out", "", "Output directory (required)")
+	folders := flags.String("folders", "", "Comma-separated folders to export (default: all)")
+	flags.Parse(args)
+
+	opts := exportOptions{server: *server, format: *format, out: *out}
+	if opts.server == "" || opts.out == "" {
+		fmt.Fprintln(os.Stderr, "export: -server and -out are required")
+		flags.Usage()
+		return 2
+	}
+	if opts.format != "maildir" && opts.format != "mbox" {
+		fmt.Fprintln(os.Stderr, "export: -format must be maildir or mbox")
+		return 2
+	}
+	if *since != "" {
+		date, err := time.Parse("2006-01-02", *since)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: invalid -since date %q, expected YYYY-MM-DD\n", *since)
+			return 2
+		}
+		opts.since = date
+	}
+	for _, folder := range strings.Split(*folders, ",") {
+		if folder = strings.TrimSpace(folder); folder != "" {
+			opts.folders = append(opts.folders, folder)
+		}
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		LogError("Failed to load configuration: %v", err)
+		return 1
+	}
+	SetLogLevel(cfg.LogLevel)
+	if err := exportMailbox(cfg, opts); err != nil {
+		LogError("Export failed: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// exportMailbox exports the folders of one server
+func exportMailbox(cfg *Config, opts exportOptions) error {
+	server := cfg.GetServerByName(opts.server)
+	if server == nil || server.IMAP == nil {
+		return fmt.Errorf("server %q does not exist or has no imap settings", opts.server)
+	}
+	if err := os.MkdirAll(opts.out, 0700); err != nil {
+		return err
+	}
+	state, err := loadExportState(opts)
+	if err != nil {
+		return err
+	}
+
+	upstream, err := dialIMAP(server.IMAP, cfg.Timeouts, "export")
+	if err != nil {
+		return err
+	}
+	defer upstream.logout()
+
+	mailboxes, err := upstream.listFolders("*")
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool)
+	for _, folder := range opts.folders {
+		wanted[folder] = true
+	}
+	total := 0
+	for _, mailbox := range mailboxes {
+		if mailbox.hasAttribute(`\Noselect`) || mailbox.hasAttribute(`\NonExistent`) {
+			continue
+		}
+		if len(wanted) > 0 && !wanted[mailbox.Name] {
+			continue
+		}
+		delete(wanted, mailbox.Name)
+		n, err := exportFolder(upstream, mailbox, opts, state)
+		total += n
+		if err != nil {
+			return fmt.Errorf("%s: %w", mailbox.Name, err)
+		}
+	}
+	for folder := range wanted {
+		LogError("Folder %s does not exist on %s", folder, opts.server)
+	}
+	LogInfo("Exported %d new emails of %s to %s", total, server.IMAP.Username, opts.out)
+	return nil
+}
+
+// exportFolder exports the messages of a folder above the last exported UID
+func exportFolder(upstream *imapClient, mailbox mailboxInfo, opts exportOptions, state *exportState) (int, error) {
+	status, err := upstream.selectStatus(mailbox.Name)
+	if err != nil {
+		return 0, err
+	}
+	folder := state.Folders[mailbox.Name]
+	if folder == nil || folder.UIDValidity != status.UIDValidity {
+		if folder != nil {
+			LogInfo("UIDVALIDITY of %s changed, exporting it again", mailbox.Name)
+		}
+		folder = &exportFolderState{UIDValidity: status.UIDValidity}
+		state.Folders[mailbox.Name] = folder
+	}
+	if status.Exists == 0 {
+		return 0, saveExportState(opts.out, state)
+	}
+
+	criteria := fmt.Sprintf("UID %d:*", folder.LastUID+1)
+	if !opts.since.IsZero() {
+		criteria += " SINCE " + opts.since.Format("2-Jan-2006")
+	}
+	uids, err := upstream.search(criteria)
+	if err != nil {
+		return 0, err
+	}
+	sort.Ints(uids)
+
+	exported := 0
+	for _, uid := range uids {
+		// UID n:* always matches the last message, even when its UID is below n
+		if uid <= folder.LastUID {
+			continue
+		}
+		msg, err := upstream.fetchArchived(uid)
+		if err != nil {
+			return exported, err
+		}
+		if err := writeExported(mailbox, opts, status.UIDValidity, uid, msg); err != nil {
+			return exported, err
+		}
+		folder.LastUID = uid
+		if err := saveExportState(opts.out, state); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	if exported > 0 {
+		LogInfo("📦 EXPORT: %d emails from %s", exported, mailbox.Name)
+	}
+	return exported, saveExportState(opts.out, state)
+}
+
+// writeExported stores one message. Maildir files are named after the
+// INTERNALDATE and UID and carry the flags in their info suffix; mbox entries
+// carry the INTERNALDATE in the From_ line and the flags in Status/X-Status.
+func writeExported(mailbox mailboxInfo, opts exportOptions, validity uint32, uid int, msg *archivedMessage) error {
+	date := msg.InternalDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	if opts.format == "mbox" {
+		path := filepath.Join(opts.out, exportFolderName(mailbox, "")+".mbox")
+		return appendMbox(path, date, mboxStatusHeaders(msg.Flags, msg.Data))
+	}
+
+	dir := opts.out
+	if !strings.EqualFold(mailbox.Name, "INBOX") {
+		// Maildir++ layout: subfolders are .Name directories of the top Maildir
+		dir = filepath.Join(opts.out, "."+exportFolderName(mailbox, "."))
+	}
+	name := fmt.Sprintf("%d.U%dV%d.%s:2,%s", date.Unix(), uid, validity, maildirHostname(), maildirFlags(msg.Flags))
+	return writeMaildir(dir, "cur", name, unixLineEndings(msg.Data), msg.InternalDate)
+}
+
+// exportFolderName turns a mailbox name into a single file name, joining the
+// hierarchy levels with sep (or with "." when sep is empty)
+func exportFolderName(mailbox mailboxInfo, sep string) string {
+	if sep == "" {
+		sep = "."
+	}
+	name := mailbox.Name
+	if mailbox.Delimiter != "" {
+		name = strings.ReplaceAll(name, mailbox.Delimiter, sep)
+	}
+	name = strings.ReplaceAll(name, "/", "_")
+	if name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+// maildirFlags maps IMAP flags to the Maildir info letters, in ASCII order
+func maildirFlags(flags []string) string {
+	letters := map[string]byte{`\DRAFT`: 'D', `\FLAGGED`: 'F', `\ANSWERED`: 'R', `\SEEN`: 'S', `\DELETED`: 'T'}
+	var info []byte
+	for _, flag := range flags {
+		if letter, ok := letters[strings.ToUpper(flag)]; ok {
+			info = append(info, letter)
+		}
+	}
+	sort.Slice(info, func(i, j int) bool { return info[i] < info[j] })
+	return string(info)
+}
+
+// mboxStatusHeaders prepends the Status and X-Status headers mbox readers use for flags
+func mboxStatusHeaders(flags []string, data []byte) []byte {
+	status, xstatus := "O", ""
+	for _, flag := range flags {
+		switch strings.ToUpper(flag) {
+		case `\SEEN`:
+			status = "RO"
+		case `\ANSWERED`:
+			xstatus += "A"
+		case `\FLAGGED`:
+			xstatus += "F"
+		case `\DRAFT`:
+			xstatus += "T"
+		case `\DELETED`:
+			xstatus += "D"
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Status: %s\r\n", status)
+	if xstatus != "" {
+		fmt.Fprintf(&buf, "X-Status: %s\r\n", xstatus)
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// loadExportState reads the state of an earlier export into the same directory
+func loadExportState(opts exportOptions) (*exportState, error) {
+	state := &exportState{Server: opts.server, Format: opts.format, Folders: make(map[string]*exportFolderState)}
+	data, err := os.ReadFile(filepath.Join(opts.out, exportStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %w", exportStateFile, err)
+	}
+	if state.Server != opts.server || state.Format != opts.format {
+		return nil, fmt.Errorf("%s holds a %s export of server %q; use another directory", opts.out, state.Format, state.Server)
+	}
+	if state.Folders == nil {
+		state.Folders = make(map[string]*exportFolderState)
+	}
+	return state, nil
+}
+
+// saveExportState replaces the state file atomically and syncs it
+func saveExportState(dir string, state *exportState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeSynced(filepath.Join(dir, exportStateFile), data)
+}
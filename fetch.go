@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchRunner runs the configured fetch jobs: every interval it pulls the
+// messages of an upstream mailbox that were not delivered before and hands
+// them to a local delivery target (fetchmail mode)
+type fetchRunner struct {
+	servers  *Config
+	timeouts TimeoutConfig
+	pool     *imapPool
+	logins   *loginLimiter
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// fetchState is the state file of a fetch job. It lists the IDs of delivered
+// messages still on the server, so every message is delivered once.
+type fetchState struct {
+	Delivered []string `json:"delivered"`
+}
+
+func newFetchRunner(config *Config, pool *imapPool, logins *loginLimiter) *fetchRunner {
+	r := &fetchRunner{
+		servers:  config,
+		timeouts: config.Timeouts,
+		pool:     pool,
+		logins:   logins,
+		stop:     make(chan struct{}),
+	}
+	for _, job := range config.Fetch {
+		r.wg.Add(1)
+		go r.schedule(job)
+	}
+	return r
+}
+
+// close stops the schedules and waits for running fetches to finish
+func (r *fetchRunner) close() {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// schedule runs a job at startup and then every interval
+func (r *fetchRunner) schedule(job FetchJobConfig) {
+	defer r.wg.Done()
+	LogInfo("Fetch job %s: fetching %s of %s every %v", job.Name, job.Folder, job.Server, job.Interval)
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.run(job); err != nil {
+			LogError("Fetch job %s failed: %v", job.Name, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// run fetches and delivers the new messages of one job
+func (r *fetchRunner) run(job FetchJobConfig) error {
+	state, err := loadFetchState(job.StateFile)
+	if err != nil {
+		return err
+	}
+	server := r.servers.GetServerByName(job.Server)
+	if server.IMAP != nil {
+		return r.runIMAP(job, server.IMAP, state)
+	}
+	return r.runPOP3(job, server.POP3, state)
+}
+
+// runIMAP fetches from an IMAP folder; message IDs are UIDVALIDITY.UID
+func (r *fetchRunner) runIMAP(job FetchJobConfig, config *MailServerConfig, state map[string]bool) error {
+	upstream, err := r.pool.get(config, "fetch:"+job.Name)
+	if err != nil {
+		return err
+	}
+	defer r.pool.put(upstream)
+
+	status, err := upstream.selectStatus(job.Folder)
+	if err != nil {
+		return err
+	}
+	messages, err := upstream.listMessages(1, status.Exists)
+	if err != nil {
+		return err
+	}
+
+	messageID := func(msg IMAPMessage) string {
+		return fmt.Sprintf("%d.%d", status.UIDValidity, msg.UID)
+	}
+	present := make(map[string]bool)
+	for _, msg := range messages {
+		present[messageID(msg)] = true
+	}
+
+	var delivered []int
+	var deliverErr error
+	for _, msg := range messages {
+		id := messageID(msg)
+		if state[id] {
+			delivered = append(delivered, msg.UID)
+			continue
+		}
+		if deliverErr != nil {
+			continue
+		}
+		data, err := upstream.fetchMessage(msg.UID)
+		if err == nil {
+			err = deliverMessage(job.Deliver, data)
+		}
+		if err != nil {
+			deliverErr = fmt.Errorf("message UID %d: %w", msg.UID, err)
+			continue
+		}
+		state[id] = true
+		if err := saveFetchState(job.StateFile, state, present); err != nil {
+			return err
+		}
+		delivered = append(delivered, msg.UID)
+		LogInfo("📥 FETCH: %s delivered message UID %d (%d bytes) from %s", job.Name, msg.UID, len(data), config.Username)
+	}
+	if err := saveFetchState(job.StateFile, state, present); err != nil {
+		return err
+	}
+
+	// Delivered messages left on the server by an earlier failed run are removed too
+	if len(delivered) > 0 {
+		switch job.AfterDelivery {
+		case "delete":
+			err = upstream.expungeUIDs(delivered)
+		case "move":
+			err = upstream.moveUIDs(delivered, job.MoveTo)
+		}
+		if err != nil {
+			return fmt.Errorf("after_delivery %s: %w", job.AfterDelivery, err)
+		}
+	}
+	return deliverErr
+}
+
+// runPOP3 fetches from a POP3 mailbox; message IDs are the UIDL
+func (r *fetchRunner) runPOP3(job FetchJobConfig, config *MailServerConfig, state map[string]bool) error {
+	if !r.logins.acquire(config) {
+		return errUpstreamLoginLimit
+	}
+	defer r.logins.release(config)
+	upstream, err := dialPOP3(config, r.timeouts)
+	if err != nil {
+		return err
+	}
+	defer upstream.close()
+
+	uidl, err := upstream.uidl()
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool)
+	numbers := make([]int, 0, len(uidl))
+	for n, id := range uidl {
+		present[id] = true
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	var deliverErr error
+	for _, n := range numbers {
+		id := uidl[n]
+		if !state[id] {
+			data, err := upstream.retr(n)
+			if err == nil {
+				err = deliverMessage(job.Deliver, data)
+			}
+			if err != nil {
+				deliverErr = fmt.Errorf("message %d (%s): %w", n, id, err)
+				break
+			}
+			state[id] = true
+			if err := saveFetchState(job.StateFile, state, present); err != nil {
+				return err
+			}
+			LogInfo("📥 FETCH: %s delivered message %s (%d bytes) from %s", job.Name, id, len(data), config.Username)
+		}
+		if job.AfterDelivery == "delete" {
+			if err := upstream.ok("DELE %d", n); err != nil {
+				return err
+			}
+		}
+	}
+	if err := saveFetchState(job.StateFile, state, present); err != nil {
+		return err
+	}
+	// QUIT commits the deletions
+	if err := upstream.ok("QUIT"); err != nil {
+		return err
+	}
+	return deliverErr
+}
+
+// loadFetchState reads the delivered message IDs of a job; a missing file is
+// an empty state
+func loadFetchState(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]bool), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state fetchState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("state file %s: %w", path, err)
+	}
+	delivered := make(map[string]bool, len(state.Delivered))
+	for _, id := range state.Delivered {
+		delivered[id] = true
+	}
+	return delivered, nil
+}
+
+// saveFetchState writes the delivered IDs that are still on the server. The
+// file is replaced atomically and synced so a crash never loses the record of
+// a delivery.
+func saveFetchState(path string, delivered, present map[string]bool) error {
+	var state fetchState
+	for id := range delivered {
+		if present[id] {
+			state.Delivered = append(state.Delivered, id)
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeSynced(path, data)
+}
+
+// pop3Client is a minimal POP3 client for fetch jobs
+type pop3Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialPOP3 connects to a POP3 server and logs in with USER and PASS
+func dialPOP3(config *MailServerConfig, timeouts TimeoutConfig) (*pop3Client, error) {
+	conn, err := dialUpstream(config, config.UseTLS, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	c := &pop3Client{conn: conn, reader: bufio.NewReader(conn)}
+	if _, err := c.response(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("greeting: %w", err)
+	}
+	if err := c.ok("USER %s", config.Username); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.ok("PASS %s", config.Password); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("login failed: %w", err)
+	}
+	return c, nil
+}
+
+func (c *pop3Client) close() {
+	c.conn.Close()
+}
+
+// response reads a status line and returns its text after +OK
+func (c *pop3Client) response() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "+OK") {
+		return "", errors.New(line)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+}
+
+// ok sends a command and expects +OK
+func (c *pop3Client) ok(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", args...); err != nil {
+		return err
+	}
+	_, err := c.response()
+	return err
+}
+
+// multiline sends a command and reads its dot-terminated answer, undoing
+// dot-stuffing; lines are returned with CRLF
+func (c *pop3Client) multiline(format string, args ...interface{}) ([]byte, error) {
+	if err := c.ok(format, args...); err != nil {
+		return nil, err
+	}
+	var data []byte
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "." {
+			return data, nil
+		}
+		data = append(data, strings.TrimPrefix(line, ".")...)
+		data = append(data, '\r', '\n')
+	}
+}
+
+// uidl returns the unique IDs of the messages by message number
+func (c *pop3Client) uidl() (map[int]string, error) {
+	data, err := c.multiline("UIDL")
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int]string)
+	for _, line := range strings.Split(string(data), "\r\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.Atoi(fields[0]); err == nil {
+			ids[n] = fields[1]
+		}
+	}
+	return ids, nil
+}
+
+// retr downloads a message
+func (c *pop3Client) retr(n int) ([]byte, error) {
+	return c.multiline("RETR %d", n)
+}
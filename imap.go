@@ -1,11 +1,1032 @@
 package main
 
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
 // IMAPMessage represents a message when using IMAP backend for POP3 translation
 type IMAPMessage struct {
-	UID  int
-	Size int
+	UID         int
+	Size        int
+	Folder      string // IMAP mailbox the message is in
+	UIDValidity uint32 // of Folder; 0 when the server did not report it
+}
+
+// errIMAPAuthFailed is returned by dialIMAP when the server rejects LOGIN
+var errIMAPAuthFailed = errors.New("IMAP login rejected")
+
+// imapClient is an authenticated connection to an upstream IMAP server.
+// It is used by one session at a time.
+type imapClient struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	config       *MailServerConfig
+	tag          int
+	caps         map[string]bool
+	selected     bool      // a mailbox is selected and must be reset before reuse
+	mailbox      string    // name of the selected mailbox
+	broken       bool      // a command did not complete; the connection cannot be reused
+	session      string    // client address for log lines
+	lastActivity time.Time // last completed command
+	idleSince    time.Time // returned to the pool
+	literalSink  io.Writer // receives the BODY[] literal of sinkUID instead of memory (streamMessage)
+	sinkUID      string
+
+	responseTimeout time.Duration // upstream_response, restored after IDLE
+}
+
+// dialIMAP connects to an upstream IMAP server and logs in with the mailbox credentials
+func dialIMAP(config *MailServerConfig, timeouts TimeoutConfig, session string) (*imapClient, error) {
+	conn, err := dialUpstream(config, config.UseTLS, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	c := &imapClient{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		config:  config,
+		tag:     1000,
+		caps:    make(map[string]bool),
+		session: session,
+
+		responseTimeout: timeouts.UpstreamResponse,
+	}
+
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading IMAP greeting from %s: %w", upstreamAddr(config), err)
+	}
+	log.Printf("[IMAP] IMAP-SERVER -> PROXY (%s): %s", session, greeting)
+	if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting from %s: %s", upstreamAddr(config), greeting)
+	}
+
+	result, err := c.run(fmt.Sprintf("LOGIN %s %s", imapQuote(config.Username), imapQuote(config.Password)),
+		fmt.Sprintf("LOGIN %s [hidden]", config.Username), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !imapOK(result) {
+		conn.Close()
+		return nil, fmt.Errorf("%w for %s: %s", errIMAPAuthFailed, config.Username, result)
+	}
+
+	if _, err := c.command(c.parseCapabilities, "CAPABILITY"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// command sends a tagged command and reads the response up to its tagged
+// completion, passing untagged and continuation lines to handle (which may be
+// nil). It returns the completion without the tag, e.g. "OK SELECT completed".
+func (c *imapClient) command(handle func(line string), format string, args ...interface{}) (string, error) {
+	cmd := fmt.Sprintf(format, args...)
+	return c.run(cmd, cmd, func(line string, literals [][]byte) {
+		if handle != nil {
+			handle(line)
+		}
+	})
+}
+
+// fetch is command for responses that carry literals, such as message bodies:
+// handle receives each response line together with the literals it contained
+func (c *imapClient) fetch(handle func(line string, literals [][]byte), format string, args ...interface{}) (string, error) {
+	cmd := fmt.Sprintf(format, args...)
+	return c.run(cmd, cmd, handle)
+}
+
+// run sends a command, logging logged instead of cmd so credentials stay out of the log
+func (c *imapClient) run(cmd, logged string, handle func(line string, literals [][]byte)) (string, error) {
+	tag, err := c.send(cmd, logged)
+	if err != nil {
+		return "", err
+	}
+	return c.wait(tag, handle)
+}
+
+// send writes a tagged command and returns its tag
+func (c *imapClient) send(cmd, logged string) (string, error) {
+	c.tag++
+	tag := fmt.Sprintf("A%d", c.tag)
+	log.Printf("[IMAP] PROXY -> IMAP-SERVER (%s): %s %s", c.session, tag, logged)
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, cmd); err != nil {
+		c.broken = true
+		return "", err
+	}
+	return tag, nil
+}
+
+// wait reads responses until the completion of the command with the given tag
+func (c *imapClient) wait(tag string, handle func(line string, literals [][]byte)) (string, error) {
+	prefix := tag + " "
+	for {
+		line, literals, err := c.readResponse()
+		if err != nil {
+			c.broken = true
+			return "", err
+		}
+		log.Printf("[IMAP] IMAP-SERVER -> PROXY (%s): %s", c.session, line)
+		if strings.HasPrefix(line, prefix) {
+			c.lastActivity = time.Now()
+			return line[len(prefix):], nil
+		}
+		if handle != nil {
+			handle(line, literals)
+		}
+	}
+}
+
+// readResponse reads one response line. A literal announced with {n} at the end
+// of a line is read as exactly n bytes, and the line continues after it; the
+// returned text keeps the {n} markers but not the literal data.
+func (c *imapClient) readResponse() (string, [][]byte, error) {
+	var text strings.Builder
+	var literals [][]byte
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return "", nil, err
+		}
+		text.WriteString(line)
+		size, ok := literalSize(line)
+		if !ok {
+			return text.String(), literals, nil
+		}
+		if c.literalSink != nil && c.sinkTakes(text.String()) {
+			sink := c.literalSink
+			c.literalSink = nil
+			if _, err := io.CopyN(sink, c.reader, int64(size)); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return "", nil, err
+		}
+		literals = append(literals, data)
+	}
+}
+
+// sinkTakes reports whether the literal announced at the end of text is the
+// BODY[] of the message streamMessage waits for. Unsolicited FETCH responses
+// for other messages, and UIDs the server only sends after the literal, do
+// not qualify.
+func (c *imapClient) sinkTakes(text string) bool {
+	_, attrs, ok := parseFetchLine(text)
+	if !ok || fetchAttr(attrs, "UID") != c.sinkUID {
+		return false
+	}
+	item := strings.TrimSpace(text[:strings.LastIndexByte(text, '{')])
+	return strings.HasSuffix(strings.ToUpper(item), "BODY[]")
+}
+
+// literalSize parses the {n} literal announcement at the end of a line
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false
+	}
+	size, err := strconv.Atoi(line[open+1 : len(line)-1])
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// readLine reads one response line without its CRLF
+func (c *imapClient) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// parseCapabilities records the capabilities from an untagged CAPABILITY response
+func (c *imapClient) parseCapabilities(line string) {
+	if !strings.HasPrefix(strings.ToUpper(line), "* CAPABILITY ") {
+		return
+	}
+	for _, capability := range strings.Fields(line)[2:] {
+		c.caps[strings.ToUpper(capability)] = true
+	}
+}
+
+// selectMailbox opens a mailbox read-write, passing untagged lines such as
+// "* 12 EXISTS" to handle
+func (c *imapClient) selectMailbox(mailbox string, handle func(line string)) (string, error) {
+	result, err := c.command(handle, "SELECT %s", imapQuote(mailbox))
+	if err == nil && imapOK(result) {
+		c.selected = true
+		c.mailbox = mailbox
+	} else if err == nil {
+		// A failed SELECT leaves no mailbox selected (RFC 3501 6.3.1)
+		c.selected = false
+		c.mailbox = ""
+	}
+	return result, err
+}
+
+// folderStatus is what SELECT reports about a mailbox
+type folderStatus struct {
+	Exists      int
+	UIDValidity uint32
+	UIDNext     uint32
+}
+
+// folderSnapshot is the message list of a mailbox kept up to date by the
+// mailbox watcher
+type folderSnapshot struct {
+	folderStatus
+	Messages []IMAPMessage
+}
+
+// matches reports whether the snapshot describes the mailbox SELECT just
+// reported: an arrival changes UIDNEXT and an expunge changes EXISTS
+func (s *folderSnapshot) matches(status folderStatus) bool {
+	return s != nil && status.UIDNext != 0 && s.folderStatus == status && len(s.Messages) == status.Exists
+}
+
+// uidNext returns the UIDNEXT of a mailbox from STATUS. Servers answer it for
+// the selected mailbox too, which RFC 3501 only discourages.
+func (c *imapClient) uidNext(mailbox string) (uint32, error) {
+	var next uint32
+	result, err := c.command(func(line string) {
+		if !strings.HasPrefix(strings.ToUpper(line), "* STATUS ") {
+			return
+		}
+		items := line[strings.LastIndexByte(line, '(')+1:]
+		if v, err := strconv.ParseUint(fetchAttr(items, "UIDNEXT"), 10, 32); err == nil {
+			next = uint32(v)
+		}
+	}, "STATUS %s (UIDNEXT)", imapQuote(mailbox))
+	if err != nil {
+		return 0, err
+	}
+	if !imapOK(result) || next == 0 {
+		return 0, fmt.Errorf("STATUS %s failed: %s", mailbox, result)
+	}
+	return next, nil
+}
+
+// selectStatus selects a mailbox and returns its status
+func (c *imapClient) selectStatus(folder string) (folderStatus, error) {
+	var status folderStatus
+	result, err := c.selectMailbox(folder, func(line string) {
+		if v, ok := parseResponseCode(line, "UIDVALIDITY"); ok {
+			status.UIDValidity = v
+		}
+		if v, ok := parseResponseCode(line, "UIDNEXT"); ok {
+			status.UIDNext = v
+		}
+		if n, ok := parseCountResponse(line, "EXISTS"); ok {
+			status.Exists = n
+		}
+	})
+	if err != nil {
+		return status, err
+	}
+	if !imapOK(result) {
+		return status, &folderError{folder: folder, result: result}
+	}
+	return status, nil
+}
+
+// openFolder selects a mailbox and returns its messages, limited by view (which
+// may be nil). When known, a snapshot from the mailbox watcher that still
+// matches the mailbox, is used instead of fetching the message list.
+func (c *imapClient) openFolder(folder string, view *ViewConfig, known *folderSnapshot) ([]IMAPMessage, error) {
+	status, err := c.selectStatus(folder)
+	if err != nil {
+		return nil, err
+	}
+	count, uidValidity := status.Exists, status.UIDValidity
+	LogInfo("📥 %s: Found %d emails for %s", folder, count, c.config.Username)
+
+	// Real UIDs and sizes for LIST/STAT and the message cache
+	var messages []IMAPMessage
+	criteria := viewSearchCriteria(view, time.Now())
+	if criteria == "" && known.matches(status) {
+		messages = known.Messages
+		if view != nil && view.MaxMessages > 0 && len(messages) > view.MaxMessages {
+			messages = messages[len(messages)-view.MaxMessages:]
+		}
+		messages = append([]IMAPMessage(nil), messages...)
+		LogDebug("Message list of %s for %s taken from the mailbox watcher", folder, c.config.Username)
+	} else if criteria != "" && count > 0 {
+		uids, err := c.search(criteria)
+		if err != nil {
+			return nil, err
+		}
+		if view.MaxMessages > 0 && len(uids) > view.MaxMessages {
+			uids = uids[len(uids)-view.MaxMessages:]
+		}
+		if messages, err = c.listUIDs(uids); err != nil {
+			return nil, err
+		}
+	} else {
+		first := 1
+		if view != nil && view.MaxMessages > 0 && count > view.MaxMessages {
+			first = count - view.MaxMessages + 1
+		}
+		if messages, err = c.listMessages(first, count); err != nil {
+			return nil, err
+		}
+	}
+	if len(messages) < count {
+		LogInfo("View of %s for %s shows %d of %d emails", folder, c.config.Username, len(messages), count)
+	}
+	for i := range messages {
+		messages[i].Folder = folder
+		messages[i].UIDValidity = uidValidity
+	}
+	return messages, nil
+}
+
+// folderError is returned by openFolder when the server refuses to select a mailbox
+type folderError struct {
+	folder string
+	result string
+}
+
+func (e *folderError) Error() string {
+	return fmt.Sprintf("cannot select %s: %s", e.folder, e.result)
+}
+
+// selectFolder makes sure the given mailbox is the selected one
+func (c *imapClient) selectFolder(folder string) error {
+	if c.selected && c.mailbox == folder {
+		return nil
+	}
+	result, err := c.selectMailbox(folder, nil)
+	if err != nil {
+		return err
+	}
+	if !imapOK(result) {
+		return &folderError{folder: folder, result: result}
+	}
+	return nil
+}
+
+// mailboxInfo is a mailbox returned by LIST
+type mailboxInfo struct {
+	Name       string
+	Delimiter  string   // hierarchy delimiter; empty when the server has none
+	Attributes []string // e.g. \Noselect, \HasChildren, \Sent
+}
+
+// hasAttribute reports whether the mailbox has a LIST attribute, ignoring case
+func (m mailboxInfo) hasAttribute(name string) bool {
+	for _, attr := range m.Attributes {
+		if strings.EqualFold(attr, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// listFolders returns the mailboxes matching pattern, e.g. "*" for all
+func (c *imapClient) listFolders(pattern string) ([]mailboxInfo, error) {
+	var mailboxes []mailboxInfo
+	result, err := c.fetch(func(line string, literals [][]byte) {
+		if mailbox, ok := parseListLine(line, literals); ok {
+			mailboxes = append(mailboxes, mailbox)
+		}
+	}, "LIST \"\" %s", imapQuote(pattern))
+	if err != nil {
+		return nil, err
+	}
+	if !imapOK(result) {
+		return nil, fmt.Errorf("LIST failed: %s", result)
+	}
+	return mailboxes, nil
+}
+
+// parseListLine parses `* LIST (\HasNoChildren) "/" "INBOX"`; the name may also
+// be an atom or a literal
+func parseListLine(line string, literals [][]byte) (mailboxInfo, bool) {
+	if len(line) < 8 || !strings.EqualFold(line[:8], "* LIST (") {
+		return mailboxInfo{}, false
+	}
+	rest := line[8:]
+	end := strings.IndexByte(rest, ')')
+	if end < 0 {
+		return mailboxInfo{}, false
+	}
+	mailbox := mailboxInfo{Attributes: strings.Fields(rest[:end])}
+	rest = strings.TrimSpace(rest[end+1:])
+
+	delimiter, rest, ok := imapString(rest)
+	if !ok {
+		return mailboxInfo{}, false
+	}
+	if !strings.EqualFold(delimiter, "NIL") {
+		mailbox.Delimiter = delimiter
+	}
+	rest = strings.TrimSpace(rest)
+	if _, isLiteral := literalSize(rest); isLiteral && len(literals) > 0 {
+		mailbox.Name = string(literals[len(literals)-1])
+		return mailbox, true
+	}
+	mailbox.Name, _, ok = imapString(rest)
+	return mailbox, ok && mailbox.Name != ""
+}
+
+// imapString reads a quoted string or an atom from the start of s and returns
+// it unquoted together with the remaining text
+func imapString(s string) (string, string, bool) {
+	if !strings.HasPrefix(s, `"`) {
+		end := strings.IndexByte(s, ' ')
+		if end < 0 {
+			end = len(s)
+		}
+		return s[:end], s[end:], end > 0
+	}
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+			}
+		case '"':
+			return value.String(), s[i+1:], true
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return "", "", false
+}
+
+// listMessages returns the UID and size of messages first..last of the selected mailbox
+func (c *imapClient) listMessages(first, last int) ([]IMAPMessage, error) {
+	if last < first {
+		return nil, nil
+	}
+	messages := make([]IMAPMessage, last-first+1)
+	result, err := c.command(func(line string) {
+		seq, attrs, ok := parseFetchLine(line)
+		if !ok || seq < first || seq > last {
+			return
+		}
+		if uid, err := strconv.Atoi(fetchAttr(attrs, "UID")); err == nil {
+			messages[seq-first].UID = uid
+		}
+		if size, err := strconv.Atoi(fetchAttr(attrs, "RFC822.SIZE")); err == nil {
+			messages[seq-first].Size = size
+		}
+	}, "FETCH %d:%d (UID RFC822.SIZE)", first, last)
+	if err != nil {
+		return nil, err
+	}
+	if !imapOK(result) {
+		return nil, fmt.Errorf("FETCH failed: %s", result)
+	}
+	for i, msg := range messages {
+		if msg.UID == 0 {
+			return nil, fmt.Errorf("server returned no UID for message %d", first+i)
+		}
+	}
+	return messages, nil
+}
+
+// listUIDs returns the size of the messages with the given UIDs, in UID order.
+// Messages expunged in the meantime are left out.
+func (c *imapClient) listUIDs(uids []int) ([]IMAPMessage, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	sizes := make(map[int]int, len(uids))
+	result, err := c.command(func(line string) {
+		_, attrs, ok := parseFetchLine(line)
+		if !ok {
+			return
+		}
+		uid, err := strconv.Atoi(fetchAttr(attrs, "UID"))
+		if err != nil {
+			return
+		}
+		if size, err := strconv.Atoi(fetchAttr(attrs, "RFC822.SIZE")); err == nil {
+			sizes[uid] = size
+		}
+	}, "UID FETCH %s (UID RFC822.SIZE)", uidSet(uids))
+	if err != nil {
+		return nil, err
+	}
+	if !imapOK(result) {
+		return nil, fmt.Errorf("FETCH failed: %s", result)
+	}
+	messages := make([]IMAPMessage, 0, len(uids))
+	for _, uid := range uids {
+		if size, ok := sizes[uid]; ok {
+			messages = append(messages, IMAPMessage{UID: uid, Size: size})
+		}
+	}
+	return messages, nil
+}
+
+// search runs UID SEARCH on the selected mailbox and returns the UIDs in ascending order
+func (c *imapClient) search(criteria string) ([]int, error) {
+	var uids []int
+	result, err := c.command(func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "*" || !strings.EqualFold(fields[1], "SEARCH") {
+			return
+		}
+		for _, field := range fields[2:] {
+			if uid, err := strconv.Atoi(field); err == nil {
+				uids = append(uids, uid)
+			}
+		}
+	}, "UID SEARCH %s", criteria)
+	if err != nil {
+		return nil, err
+	}
+	if !imapOK(result) {
+		return nil, fmt.Errorf("SEARCH failed: %s", result)
+	}
+	sort.Ints(uids)
+	return uids, nil
+}
+
+// viewSearchCriteria returns the SEARCH criteria of a view, or "" when it
+// needs no search (no view, or only max_messages)
+func viewSearchCriteria(view *ViewConfig, now time.Time) string {
+	if view == nil {
+		return ""
+	}
+	var criteria []string
+	if view.MaxAgeDays > 0 {
+		criteria = append(criteria, "SINCE "+now.AddDate(0, 0, -view.MaxAgeDays).Format("2-Jan-2006"))
+	}
+	if view.UnseenOnly {
+		criteria = append(criteria, "UNSEEN")
+	}
+	if view.MaxSizeMB > 0 {
+		criteria = append(criteria, fmt.Sprintf("SMALLER %d", view.MaxSizeMB<<20))
+	}
+	return strings.Join(criteria, " ")
+}
+
+// fetchMessage returns the raw message with the given UID. BODY.PEEK[] leaves
+// the \Seen flag alone, unlike RFC822.
+func (c *imapClient) fetchMessage(uid int) ([]byte, error) {
+	return c.fetchSection(uid, "BODY.PEEK[]")
+}
+
+// archivedMessage is a message with the flags and INTERNALDATE the server keeps for it
+type archivedMessage struct {
+	Data         []byte
+	Flags        []string
+	InternalDate time.Time // zero when the server sent none
+}
+
+// fetchArchived returns a message together with its flags and INTERNALDATE,
+// without setting \Seen
+func (c *imapClient) fetchArchived(uid int) (*archivedMessage, error) {
+	var msg *archivedMessage
+	result, err := c.fetch(func(line string, literals [][]byte) {
+		_, attrs, ok := parseFetchLine(line)
+		if !ok || fetchAttr(attrs, "UID") != strconv.Itoa(uid) {
+			return
+		}
+		msg = &archivedMessage{}
+		if len(literals) > 0 {
+			msg.Data = literals[0]
+		}
+		if start := strings.Index(strings.ToUpper(attrs), "FLAGS ("); start >= 0 {
+			flags := attrs[start+len("FLAGS ("):]
+			if end := strings.IndexByte(flags, ')'); end >= 0 {
+				msg.Flags = strings.Fields(flags[:end])
+			}
+		}
+		if start := strings.Index(strings.ToUpper(attrs), `INTERNALDATE "`); start >= 0 {
+			date := attrs[start+len(`INTERNALDATE "`):]
+			if end := strings.IndexByte(date, '"'); end >= 0 {
+				msg.InternalDate, _ = time.Parse("2-Jan-2006 15:04:05 -0700", strings.TrimSpace(date[:end]))
+			}
+		}
+	}, "UID FETCH %d (UID FLAGS INTERNALDATE BODY.PEEK[])", uid)
+	if err != nil {
+		return nil, err
+	}
+	if !imapOK(result) {
+		return nil, fmt.Errorf("FETCH failed: %s", result)
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("message UID %d not returned by server", uid)
+	}
+	return msg, nil
+}
+
+// streamMessage copies the message with the given UID to w as it arrives from
+// the server, exactly as many bytes as the literal announces, without holding
+// it in memory. A server that sends the UID after the message is answered
+// from memory instead.
+func (c *imapClient) streamMessage(uid int, w io.Writer) error {
+	c.literalSink, c.sinkUID = w, strconv.Itoa(uid)
+	var writeErr error
+	result, err := c.fetch(func(line string, literals [][]byte) {
+		_, attrs, ok := parseFetchLine(line)
+		if c.literalSink == nil || !ok || fetchAttr(attrs, "UID") != c.sinkUID || len(literals) == 0 {
+			return
+		}
+		_, writeErr = w.Write(literals[0])
+		c.literalSink = nil
+	}, "UID FETCH %d (BODY.PEEK[])", uid)
+	streamed := c.literalSink == nil
+	c.literalSink = nil
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if !imapOK(result) {
+		return fmt.Errorf("FETCH failed: %s", result)
+	}
+	if !streamed {
+		return fmt.Errorf("message UID %d not returned by server", uid)
+	}
+	return nil
+}
+
+// markSeen sets the \Seen flag of the messages with the given UIDs
+func (c *imapClient) markSeen(uids ...int) error {
+	return c.commandOK("UID STORE %s +FLAGS.SILENT (\\Seen)", uidSet(uids))
+}
+
+// expungeUIDs flags messages \Deleted and expunges them. With UIDPLUS only
+// these messages are expunged; otherwise EXPUNGE also removes messages other
+// clients flagged \Deleted.
+func (c *imapClient) expungeUIDs(uids []int) error {
+	set := uidSet(uids)
+	if err := c.commandOK("UID STORE %s +FLAGS.SILENT (\\Deleted)", set); err != nil {
+		return err
+	}
+	if c.caps["UIDPLUS"] {
+		return c.commandOK("UID EXPUNGE %s", set)
+	}
+	return c.commandOK("EXPUNGE")
+}
+
+// moveUIDs moves messages to another mailbox, with MOVE (RFC 6851) when the
+// server has it and COPY followed by expunging the originals otherwise
+func (c *imapClient) moveUIDs(uids []int, mailbox string) error {
+	if c.caps["MOVE"] {
+		return c.commandOK("UID MOVE %s %s", uidSet(uids), imapQuote(mailbox))
+	}
+	if err := c.commandOK("UID COPY %s %s", uidSet(uids), imapQuote(mailbox)); err != nil {
+		return err
+	}
+	return c.expungeUIDs(uids)
+}
+
+// removeInboxLabel archives messages on Gmail by removing their \Inbox label;
+// they stay in All Mail
+func (c *imapClient) removeInboxLabel(uids []int) error {
+	if !c.caps["X-GM-EXT-1"] {
+		return errors.New("server does not support Gmail labels (X-GM-EXT-1)")
+	}
+	return c.commandOK("UID STORE %s -X-GM-LABELS (\\Inbox)", uidSet(uids))
+}
+
+// appendMessage stores a message in a mailbox with APPEND. The message is sent
+// as a literal after the server's continuation request.
+func (c *imapClient) appendMessage(mailbox, flags string, data []byte) error {
+	cmd := fmt.Sprintf("APPEND %s (%s) {%d}", imapQuote(mailbox), flags, len(data))
+	tag, err := c.send(cmd, cmd)
+	if err != nil {
+		return err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.broken = true
+			return err
+		}
+		log.Printf("[IMAP] IMAP-SERVER -> PROXY (%s): %s", c.session, line)
+		if strings.HasPrefix(line, "+") {
+			break
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return fmt.Errorf("APPEND failed: %s", line[len(tag)+1:])
+		}
+	}
+	if _, err := c.conn.Write(append(data[:len(data):len(data)], '\r', '\n')); err != nil {
+		c.broken = true
+		return err
+	}
+	result, err := c.wait(tag, nil)
+	if err != nil {
+		return err
+	}
+	if !imapOK(result) {
+		return fmt.Errorf("APPEND failed: %s", result)
+	}
+	return nil
+}
+
+// commandOK runs a command that is expected to complete with OK
+func (c *imapClient) commandOK(format string, args ...interface{}) error {
+	result, err := c.command(nil, format, args...)
+	if err != nil {
+		return err
+	}
+	if !imapOK(result) {
+		verb := strings.Fields(format)[0]
+		if verb == "UID" {
+			verb = strings.Fields(format)[1]
+		}
+		return fmt.Errorf("%s failed: %s", verb, result)
+	}
+	return nil
+}
+
+// fetchTop returns the header and at least the first bodyLines lines of the
+// body of a message, or the whole body when it is shorter. The body is
+// fetched in growing partial ranges so TOP on a message with large
+// attachments costs roughly what it returns. size is the RFC822.SIZE of the
+// message and bounds the ranges.
+func (c *imapClient) fetchTop(uid, bodyLines, size int) ([]byte, error) {
+	header, err := c.fetchSection(uid, "BODY.PEEK[HEADER]")
+	if err != nil {
+		return nil, err
+	}
+	if bodyLines == 0 {
+		return header, nil
+	}
+
+	length := bodyLines*topBytesPerLine + topBytesExtra
+	for {
+		body, err := c.fetchSection(uid, fmt.Sprintf("BODY.PEEK[TEXT]<0.%d>", length))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) < length || length >= size || bytes.Count(body, []byte("\n")) >= bodyLines {
+			return append(header, body...), nil
+		}
+		length *= 4
+	}
+}
+
+const (
+	// topBytesPerLine and topBytesExtra size the first partial fetch for TOP
+	topBytesPerLine = 100
+	topBytesExtra   = 1024
+)
+
+// fetchSection returns one FETCH data item, such as BODY.PEEK[] or BODY.PEEK[HEADER],
+// of the message with the given UID. A section the server returns as NIL or
+// with no literal is returned as empty.
+func (c *imapClient) fetchSection(uid int, item string) ([]byte, error) {
+	var data []byte
+	found := false
+	result, err := c.fetch(func(line string, literals [][]byte) {
+		if _, attrs, ok := parseFetchLine(line); ok && fetchAttr(attrs, "UID") == strconv.Itoa(uid) {
+			found = true
+			if len(literals) > 0 {
+				data = literals[0]
+			}
+		}
+	}, "UID FETCH %d (%s)", uid, item)
+	if err != nil {
+		return nil, err
+	}
+	if !imapOK(result) {
+		return nil, fmt.Errorf("FETCH failed: %s", result)
+	}
+	if !found {
+		return nil, fmt.Errorf("message UID %d not returned by server", uid)
+	}
+	return data, nil
+}
+
+// parseCountResponse extracts n from "* n EXISTS" and similar responses
+func parseCountResponse(line, name string) (int, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "*" || !strings.EqualFold(fields[2], name) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(fields[1])
+	return n, err == nil
+}
+
+// parseResponseCode extracts n from a response code such as "* OK [UIDVALIDITY n] ..."
+func parseResponseCode(line, name string) (uint32, bool) {
+	code := "[" + name + " "
+	start := strings.Index(strings.ToUpper(line), code)
+	if start < 0 {
+		return 0, false
+	}
+	rest := line[start+len(code):]
+	end := strings.IndexByte(rest, ']')
+	if end < 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(rest[:end], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(v), true
+}
+
+// parseFetchLine splits "* 12 FETCH (UID 34 ...)" into the sequence number and attribute text
+func parseFetchLine(line string) (int, string, bool) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 4 || fields[0] != "*" || !strings.EqualFold(fields[2], "FETCH") {
+		return 0, "", false
+	}
+	seq, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, "", false
+	}
+	return seq, fields[3], true
+}
+
+// fetchAttr returns the atom following name in a FETCH attribute list
+func fetchAttr(attrs, name string) string {
+	fields := strings.Fields(strings.Trim(attrs, "()"))
+	for i := 0; i+1 < len(fields); i++ {
+		if strings.EqualFold(fields[i], name) {
+			return strings.Trim(fields[i+1], "()")
+		}
+	}
+	return ""
 }
 
-// Additional IMAP-related structures and functions can be added here
-// as the service evolves to support more IMAP features
+// unselect leaves the selected mailbox without expunging anything, so the
+// connection can be handed to another session
+func (c *imapClient) unselect() error {
+	if !c.selected {
+		return nil
+	}
+	if c.caps["UNSELECT"] {
+		result, err := c.command(nil, "UNSELECT")
+		if err != nil {
+			return err
+		}
+		if !imapOK(result) {
+			return fmt.Errorf("UNSELECT failed: %s", result)
+		}
+	} else {
+		// CLOSE on a read-only mailbox does not expunge (RFC 3501 6.4.2)
+		result, err := c.command(nil, "EXAMINE INBOX")
+		if err != nil {
+			return err
+		}
+		if !imapOK(result) {
+			return fmt.Errorf("EXAMINE failed: %s", result)
+		}
+		if result, err = c.command(nil, "CLOSE"); err != nil {
+			return err
+		}
+		if !imapOK(result) {
+			return fmt.Errorf("CLOSE failed: %s", result)
+		}
+	}
+	c.selected = false
+	c.mailbox = ""
+	return nil
+}
+
+// idle waits in IDLE (RFC 2177) for changes to the selected mailbox, passing
+// untagged responses to handle. IDLE ends with DONE when the server reports
+// EXISTS or EXPUNGE, after refresh, or when stop is closed.
+func (c *imapClient) idle(refresh time.Duration, stop <-chan struct{}, handle func(line string)) error {
+	c.tag++
+	tag := fmt.Sprintf("A%d", c.tag)
+	log.Printf("[IMAP] PROXY -> IMAP-SERVER (%s): %s IDLE", c.session, tag)
+	if _, err := fmt.Fprintf(c.conn, "%s IDLE\r\n", tag); err != nil {
+		c.broken = true
+		return err
+	}
+	line, err := c.readLine()
+	if err != nil {
+		c.broken = true
+		return err
+	}
+	if !strings.HasPrefix(line, "+") {
+		return fmt.Errorf("IDLE refused: %s", line)
+	}
+
+	// The server answers DONE at the latest after refresh, so reads may wait that long
+	setUpstreamTimeout(c.conn, refresh+c.responseTimeout)
+	defer setUpstreamTimeout(c.conn, c.responseTimeout)
+
+	var once sync.Once
+	done := func() {
+		once.Do(func() {
+			log.Printf("[IMAP] PROXY -> IMAP-SERVER (%s): DONE", c.session)
+			fmt.Fprintf(c.conn, "DONE\r\n")
+		})
+	}
+	timer := time.AfterFunc(refresh, done)
+	defer timer.Stop()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-stop:
+			done()
+		case <-finished:
+		}
+	}()
+
+	prefix := tag + " "
+	for {
+		line, _, err := c.readResponse()
+		if err != nil {
+			c.broken = true
+			return err
+		}
+		log.Printf("[IMAP] IMAP-SERVER -> PROXY (%s): %s", c.session, line)
+		if strings.HasPrefix(line, prefix) {
+			once.Do(func() {}) // a late timer must not send DONE after IDLE ended
+			c.lastActivity = time.Now()
+			if !imapOK(line[len(prefix):]) {
+				return fmt.Errorf("IDLE failed: %s", line[len(prefix):])
+			}
+			return nil
+		}
+		handle(line)
+		if _, ok := parseCountResponse(line, "EXISTS"); ok {
+			done()
+		} else if _, ok := parseCountResponse(line, "EXPUNGE"); ok {
+			done()
+		}
+	}
+}
+
+// noop checks that the connection is still alive
+func (c *imapClient) noop() error {
+	result, err := c.command(nil, "NOOP")
+	if err != nil {
+		return err
+	}
+	if !imapOK(result) {
+		return fmt.Errorf("NOOP failed: %s", result)
+	}
+	return nil
+}
 
+// logout ends the IMAP session and closes the connection
+func (c *imapClient) logout() {
+	if !c.broken {
+		setUpstreamTimeout(c.conn, 5*time.Second)
+		c.command(nil, "LOGOUT")
+	}
+	c.conn.Close()
+}
+
+// uidSet formats ascending UIDs as an IMAP sequence set such as "3,7:9,12",
+// joining runs so large views stay short
+func uidSet(uids []int) string {
+	var set []string
+	for i := 0; i < len(uids); {
+		j := i
+		for j+1 < len(uids) && uids[j+1] == uids[j]+1 {
+			j++
+		}
+		if j == i {
+			set = append(set, strconv.Itoa(uids[i]))
+		} else {
+			set = append(set, fmt.Sprintf("%d:%d", uids[i], uids[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(set, ",")
+}
+
+// imapOK reports whether a tagged completion is a success
+func imapOK(result string) bool {
+	return strings.HasPrefix(result, "OK")
+}
+
+// imapQuote returns s as an IMAP quoted string
+func imapQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
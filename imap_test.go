@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedIMAP returns a client whose server answers the first command with
+// reply, in which TAG stands for the command's tag
+func scriptedIMAP(t *testing.T, reply string) *imapClient {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		line, err := bufio.NewReader(server).ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, _, _ := strings.Cut(line, " ")
+		server.Write([]byte(strings.ReplaceAll(reply, "TAG", tag)))
+	}()
+	return &imapClient{conn: client, reader: bufio.NewReader(client), tag: 1000, session: "test"}
+}
+
+func TestStreamMessageSkipsOtherMessages(t *testing.T) {
+	// A flag update for UID 5 that carries body data arrives first
+	c := scriptedIMAP(t, "* 3 FETCH (UID 5 BODY[] {5}\r\nwrong FLAGS (\\Seen))\r\n"+
+		"* 4 FETCH (UID 7 BODY[] {7}\r\nmessage)\r\n"+
+		"TAG OK FETCH completed\r\n")
+	var out strings.Builder
+	if err := c.streamMessage(7, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "message" {
+		t.Errorf("streamed %q, want the body of UID 7", out.String())
+	}
+}
+
+func TestStreamMessageWithUIDAfterBody(t *testing.T) {
+	c := scriptedIMAP(t, "* 4 FETCH (BODY[] {7}\r\nmessage UID 7)\r\nTAG OK FETCH completed\r\n")
+	var out strings.Builder
+	if err := c.streamMessage(7, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "message" {
+		t.Errorf("got %q, want the body of UID 7", out.String())
+	}
+}
+
+func TestStreamMessageNotReturned(t *testing.T) {
+	c := scriptedIMAP(t, "* 3 FETCH (UID 5 BODY[] {5}\r\nwrong)\r\nTAG OK FETCH completed\r\n")
+	var out strings.Builder
+	if err := c.streamMessage(7, &out); err == nil {
+		t.Fatal("no error for a message the server did not return")
+	}
+	if out.Len() != 0 {
+		t.Errorf("wrote %q from another message", out.String())
+	}
+}
+
+// answeringIMAP returns a client whose server answers every command with
+// answer(command), in which TAG stands for the command's tag. The commands the
+// server received, without their tags, are collected in the returned slice.
+func answeringIMAP(t *testing.T, answer func(command string) string) (*imapClient, *[]string) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	var commands []string
+	go func() {
+		defer server.Close()
+		reader := bufio.NewReader(server)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+			commands = append(commands, command)
+			server.Write([]byte(strings.ReplaceAll(answer(command), "TAG", tag)))
+		}
+	}()
+	c := &imapClient{conn: client, reader: bufio.NewReader(client), tag: 1000, session: "test",
+		config: &MailServerConfig{Username: "alice@example.com"}}
+	return c, &commands
+}
+
+func TestViewSearchCriteria(t *testing.T) {
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		view *ViewConfig
+		want string
+	}{
+		{nil, ""},
+		{&ViewConfig{}, ""},
+		{&ViewConfig{MaxMessages: 50}, ""},
+		{&ViewConfig{MaxAgeDays: 30}, "SINCE 9-Feb-2024"},
+		{&ViewConfig{MaxAgeDays: 1, MaxMessages: 50}, "SINCE 9-Mar-2024"},
+		{&ViewConfig{UnseenOnly: true}, "UNSEEN"},
+		{&ViewConfig{MaxSizeMB: 10}, "SMALLER 10485760"},
+		{&ViewConfig{MaxAgeDays: 7, UnseenOnly: true, MaxSizeMB: 1, MaxMessages: 5}, "SINCE 3-Mar-2024 UNSEEN SMALLER 1048576"},
+	} {
+		if got := viewSearchCriteria(tc.view, now); got != tc.want {
+			t.Errorf("viewSearchCriteria(%+v) = %q, want %q", tc.view, got, tc.want)
+		}
+	}
+}
+
+func TestUIDSet(t *testing.T) {
+	for uids, want := range map[string]string{
+		"":            "",
+		"4":           "4",
+		"3 4":         "3:4",
+		"1 2 3 4 5":   "1:5",
+		"3 7 8 9 12":  "3,7:9,12",
+		"1 3 5":       "1,3,5",
+		"10 11 20 21": "10:11,20:21",
+	} {
+		var list []int
+		for _, f := range strings.Fields(uids) {
+			n, _ := strconv.Atoi(f)
+			list = append(list, n)
+		}
+		if got := uidSet(list); got != want {
+			t.Errorf("uidSet(%v) = %q, want %q", list, got, want)
+		}
+	}
+}
+
+func TestOpenFolderView(t *testing.T) {
+	c, commands := answeringIMAP(t, func(command string) string {
+		switch {
+		case strings.HasPrefix(command, "SELECT"):
+			return "* 9 EXISTS\r\n* OK [UIDVALIDITY 3] UIDs valid\r\nTAG OK [READ-WRITE] SELECT completed\r\n"
+		case strings.HasPrefix(command, "UID SEARCH"):
+			return "* SEARCH 12 3 10 11\r\nTAG OK SEARCH completed\r\n"
+		case strings.HasPrefix(command, "UID FETCH"):
+			return "* 1 FETCH (UID 10 RFC822.SIZE 100)\r\n* 2 FETCH (UID 11 RFC822.SIZE 110)\r\n" +
+				"* 3 FETCH (UID 12 RFC822.SIZE 120)\r\nTAG OK FETCH completed\r\n"
+		}
+		return "TAG BAD unexpected\r\n"
+	})
+
+	messages, err := c.openFolder("INBOX", &ViewConfig{UnseenOnly: true, MaxMessages: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`SELECT "INBOX"`, "UID SEARCH UNSEEN", "UID FETCH 10:12 (UID RFC822.SIZE)"}
+	if strings.Join(*commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands %q, want %q", *commands, want)
+	}
+	if len(messages) != 3 || messages[0].UID != 10 || messages[2].Size != 120 || messages[0].UIDValidity != 3 {
+		t.Errorf("messages %+v, want the three newest matches", messages)
+	}
+}
+
+func TestFetchTop(t *testing.T) {
+	body := strings.Repeat("a line of body text\r\n", 200) // 4200 bytes
+	header := "Subject: test\r\n\r\n"
+	c, commands := answeringIMAP(t, func(command string) string {
+		var data string
+		if strings.Contains(command, "[HEADER]") {
+			data = header
+		} else {
+			var length int
+			fmt.Sscanf(command[strings.Index(command, "<0.")+3:], "%d", &length)
+			data = body[:min(length, len(body))]
+		}
+		return fmt.Sprintf("* 1 FETCH (UID 7 BODY[] {%d}\r\n%s)\r\nTAG OK FETCH completed\r\n", len(data), data)
+	})
+
+	top, err := c.fetchTop(7, 60, len(header)+len(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 60 lines ask for 7024 bytes, more than the body has
+	if string(top) != header+body {
+		t.Errorf("got %d bytes, want the whole message", len(top))
+	}
+	want := []string{"UID FETCH 7 (BODY.PEEK[HEADER])", "UID FETCH 7 (BODY.PEEK[TEXT]<0.7024>)"}
+	if strings.Join(*commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands %q, want %q", *commands, want)
+	}
+
+	// Long lines need a second, larger range
+	*commands = nil
+	body = strings.Repeat(strings.Repeat("x", 300)+"\r\n", 20)
+	top, err = c.fetchTop(7, 10, len(header)+len(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(top), header+body[:10*302]) {
+		t.Error("TOP is missing body lines")
+	}
+	want = []string{"UID FETCH 7 (BODY.PEEK[HEADER])", "UID FETCH 7 (BODY.PEEK[TEXT]<0.2024>)", "UID FETCH 7 (BODY.PEEK[TEXT]<0.8096>)"}
+	if strings.Join(*commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands %q, want %q", *commands, want)
+	}
+
+	// TOP 0 needs only the header
+	*commands = nil
+	if top, err = c.fetchTop(7, 0, len(header)+len(body)); err != nil || string(top) != header {
+		t.Errorf("TOP 0: %q, %v", top, err)
+	}
+	if len(*commands) != 1 {
+		t.Errorf("TOP 0 sent %q", *commands)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errUpstreamLoginLimit is returned when a mailbox already has max_upstream_logins connections
+var errUpstreamLoginLimit = errors.New("too many upstream logins for this mailbox")
+
+const (
+	// poolSweepInterval is how often idle connections are checked for keepalive and expiry
+	poolSweepInterval = 30 * time.Second
+	// poolHealthCheckAfter: a connection unused for longer is checked with NOOP before it is leased
+	poolHealthCheckAfter = 30 * time.Second
+)
+
+// imapPool keeps authenticated upstream IMAP connections between POP3 sessions,
+// so clients that poll every few minutes do not log in to the provider each time.
+// Connections are keyed by mailbox; each one holds an upstream login slot from
+// the login limiter for as long as it is open.
+type imapPool struct {
+	mu       sync.Mutex
+	cfg      IMAPPoolConfig
+	timeouts TimeoutConfig
+	logins   *loginLimiter
+	idle     map[string][]*imapClient // by loginKey
+	stop     chan struct{}
+}
+
+func newIMAPPool(cfg IMAPPoolConfig, timeouts TimeoutConfig, logins *loginLimiter) *imapPool {
+	p := &imapPool{
+		cfg:      cfg,
+		timeouts: timeouts,
+		logins:   logins,
+		idle:     make(map[string][]*imapClient),
+		stop:     make(chan struct{}),
+	}
+	if !cfg.Disabled {
+		go p.maintain()
+	}
+	return p
+}
+
+// get leases an authenticated connection to the mailbox, reusing an idle one
+// when possible. The caller must hand it back with put.
+func (p *imapPool) get(config *MailServerConfig, session string) (*imapClient, error) {
+	for {
+		c := p.takeIdle(loginKey(config))
+		if c == nil {
+			break
+		}
+		c.session = session
+		if time.Since(c.lastActivity) < poolHealthCheckAfter {
+			LogDebug("Reusing pooled IMAP connection for %s", config.Username)
+			return c, nil
+		}
+		if err := c.noop(); err == nil {
+			LogDebug("Reusing pooled IMAP connection for %s after health check", config.Username)
+			return c, nil
+		}
+		log.Printf("[IMAP] Dropping stale pooled connection for %s", config.Username)
+		p.discard(c)
+	}
+
+	if !p.logins.acquire(config) {
+		return nil, errUpstreamLoginLimit
+	}
+	c, err := dialIMAP(config, p.timeouts, session)
+	if err != nil {
+		p.logins.release(config)
+		return nil, err
+	}
+	log.Printf("[IMAP] Logged in to %s as %s", upstreamAddr(config), config.Username)
+	return c, nil
+}
+
+// put returns a leased connection. It is reset to the unselected state and
+// kept for the next session, or logged out when it cannot be reused.
+func (p *imapPool) put(c *imapClient) {
+	if c.broken || p.cfg.Disabled {
+		p.discard(c)
+		return
+	}
+	if err := c.unselect(); err != nil {
+		log.Printf("[IMAP] Cannot reset connection for %s, closing it: %v", c.config.Username, err)
+		p.discard(c)
+		return
+	}
+	c.session = "pool"
+	c.idleSince = time.Now()
+	if !p.addIdle(c) {
+		p.discard(c)
+	}
+}
+
+// close logs out all idle connections and stops the keepalive loop
+func (p *imapPool) close() {
+	if !p.cfg.Disabled {
+		close(p.stop)
+	}
+	p.mu.Lock()
+	var idle []*imapClient
+	for key, clients := range p.idle {
+		idle = append(idle, clients...)
+		delete(p.idle, key)
+	}
+	p.mu.Unlock()
+	for _, c := range idle {
+		p.discard(c)
+	}
+}
+
+// discard logs out a connection and frees its upstream login slot
+func (p *imapPool) discard(c *imapClient) {
+	c.logout()
+	p.logins.release(c.config)
+}
+
+func (p *imapPool) takeIdle(key string) *imapClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle := p.idle[key]
+	if len(idle) == 0 {
+		return nil
+	}
+	c := idle[len(idle)-1]
+	if len(idle) == 1 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = idle[:len(idle)-1]
+	}
+	return c
+}
+
+// addIdle stores a connection for reuse; it returns false when the mailbox
+// already has max_idle_per_mailbox idle connections
+func (p *imapPool) addIdle(c *imapClient) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := loginKey(c.config)
+	if len(p.idle[key]) >= p.cfg.MaxIdlePerMailbox {
+		return false
+	}
+	p.idle[key] = append(p.idle[key], c)
+	return true
+}
+
+// maintain sends NOOP keepalives to idle connections and closes those unused
+// for longer than idle_timeout
+func (p *imapPool) maintain() {
+	ticker := time.NewTicker(poolSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.sweep()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *imapPool) sweep() {
+	now := time.Now()
+	var expired, keepalive []*imapClient
+	p.mu.Lock()
+	for key, idle := range p.idle {
+		var kept []*imapClient
+		for _, c := range idle {
+			switch {
+			case now.Sub(c.idleSince) >= p.cfg.IdleTimeout:
+				expired = append(expired, c)
+			case now.Sub(c.lastActivity) >= p.cfg.Keepalive:
+				keepalive = append(keepalive, c)
+			default:
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = kept
+		}
+	}
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		LogDebug("Closing pooled IMAP connection for %s, idle since %s", c.config.Username, c.idleSince.Format(time.RFC3339))
+		p.discard(c)
+	}
+	for _, c := range keepalive {
+		if err := c.noop(); err != nil {
+			log.Printf("[IMAP] Keepalive failed for pooled connection of %s: %v", c.config.Username, err)
+			p.discard(c)
+			continue
+		}
+		if !p.addIdle(c) {
+			p.discard(c)
+		}
+	}
+}
@@ -73,6 +73,9 @@ print_status "Installing systemd service..."
 cp proxy-mail.service /etc/systemd/system/
 chown root:root /etc/systemd/system/proxy-mail.service
 chmod 644 /etc/systemd/system/proxy-mail.service
+cp proxy-mail.socket /etc/systemd/system/
+chown root:root /etc/systemd/system/proxy-mail.socket
+chmod 644 /etc/systemd/system/proxy-mail.socket
 print_success "Systemd service installed"
 
 # Install configuration file if it doesn't exist
@@ -108,6 +111,8 @@ echo "  1. Edit /etc/proxy-mail.yaml with your email server settings"
 echo "  2. Start the service: sudo systemctl start proxy-mail"
 echo "  3. Check status: sudo systemctl status proxy-mail"
 echo "  4. View logs: sudo journalctl -u proxy-mail -f"
+echo "  Optional: let systemd bind ports 25/110 (edit ListenStream= in proxy-mail.socket first):"
+echo "     sudo systemctl enable --now proxy-mail.socket"
 echo
 print_status "Security note: The configuration file contains passwords and is only readable by root and proxy-mail group"
 
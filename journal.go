@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// journalSweepInterval is how often periods past the retention are deleted
+const journalSweepInterval = time.Hour
+
+// mailJournal keeps a copy of every message sent through the SMTP listeners
+// and every message retrieved with RETR. Each period (day or month) is a
+// Maildir, or a gzip-compressed mbox file with one gzip member per message.
+// A nil journal records nothing.
+type mailJournal struct {
+	cfg     JournalConfig
+	layout  string // time layout of period names
+	counter atomic.Int64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// journalRecord is the envelope stored with a journaled message
+type journalRecord struct {
+	Kind      string // "smtp" (sent) or "retr" (retrieved)
+	ClientIP  string
+	LocalUser string   // login of the local client
+	Upstream  string   // upstream mailbox and server
+	MailFrom  string   // smtp only
+	RcptTo    []string // smtp only
+	Response  string   // final upstream reply; smtp only
+}
+
+// journalEntry is a message being written to the journal. It is written to a
+// temporary file first, so messages streamed to a POP3 client can be journaled
+// without holding them in memory.
+type journalEntry struct {
+	journal *mailJournal
+	file    *os.File
+	date    time.Time
+	name    string
+	err     error // first write error; the entry is dropped at commit
+}
+
+func newMailJournal(cfg JournalConfig) (*mailJournal, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.Dir, "tmp"), 0700); err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	j := &mailJournal{cfg: cfg, layout: "2006-01-02", stop: make(chan struct{})}
+	if cfg.Rotate == "monthly" {
+		j.layout = "2006-01"
+	}
+	if cfg.RetentionDays > 0 {
+		j.wg.Add(1)
+		go j.sweep()
+	}
+	return j, nil
+}
+
+// close stops the retention sweeps
+func (j *mailJournal) close() {
+	if j == nil {
+		return
+	}
+	close(j.stop)
+	j.wg.Wait()
+}
+
+// record journals a message that is already in memory. SMTP messages are
+// passed as received after DATA, dot-stuffed and with the final dot line.
+func (j *mailJournal) record(rec journalRecord, data []byte) {
+	entry := j.start(rec)
+	if entry == nil {
+		return
+	}
+	if rec.Kind == "smtp" {
+		data = unstuffData(data)
+	}
+	entry.Write(data)
+	entry.commit()
+}
+
+// start opens an entry and writes the envelope headers; the message follows
+// with Write. It returns nil when the journal is disabled or cannot be written.
+func (j *mailJournal) start(rec journalRecord) *journalEntry {
+	if j == nil {
+		return nil
+	}
+	now := time.Now()
+	entry := &journalEntry{
+		journal: j,
+		date:    now,
+		name:    fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), j.counter.Add(1), maildirHostname()),
+	}
+	file, err := os.OpenFile(filepath.Join(j.cfg.Dir, "tmp", entry.name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		LogError("Journal: %v", err)
+		return nil
+	}
+	entry.file = file
+
+	var headers strings.Builder
+	header := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&headers, "X-Proxy-Mail-%s: %s\r\n", name, value)
+		}
+	}
+	header("Journal", rec.Kind)
+	header("Date", now.Format(time.RFC1123Z))
+	header("Client", rec.ClientIP)
+	header("User", rec.LocalUser)
+	header("Upstream", rec.Upstream)
+	if rec.Kind == "smtp" {
+		header("Mail-From", "<"+rec.MailFrom+">")
+	}
+	for _, rcpt := range rec.RcptTo {
+		header("Rcpt-To", "<"+rcpt+">")
+	}
+	header("Response", rec.Response)
+	entry.Write([]byte(headers.String()))
+	return entry
+}
+
+// Write never fails, so a journal that cannot be written does not break the
+// delivery it is teed from; the error is reported by commit
+func (e *journalEntry) Write(p []byte) (int, error) {
+	if e.err == nil {
+		_, e.err = e.file.Write(p)
+	}
+	return len(p), nil
+}
+
+// commit moves the entry into the Maildir or mbox of the current period
+func (e *journalEntry) commit() {
+	tmp := e.file.Name()
+	if err := e.file.Close(); e.err == nil {
+		e.err = err
+	}
+	if e.err != nil {
+		os.Remove(tmp)
+		LogError("Journal: %v", e.err)
+		return
+	}
+	period := e.date.Format(e.journal.layout)
+	var err error
+	if e.journal.cfg.Format == "mbox" {
+		err = e.journal.appendMbox(filepath.Join(e.journal.cfg.Dir, period+".mbox.gz"), e.date, tmp)
+		os.Remove(tmp)
+	} else {
+		dir := filepath.Join(e.journal.cfg.Dir, period)
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err = os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = os.Rename(tmp, filepath.Join(dir, "new", e.name))
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		LogError("Journal: %v", err)
+	}
+}
+
+// abort drops an entry whose message was not delivered
+func (e *journalEntry) abort() {
+	e.file.Close()
+	os.Remove(e.file.Name())
+}
+
+// appendMbox appends a message as one gzip member to a compressed mbox; gzip
+// readers treat concatenated members as one stream
+func (j *mailJournal) appendMbox(path string, date time.Time, tmp string) error {
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	var member bytes.Buffer
+	zw := gzip.NewWriter(&member)
+	if _, err := zw.Write(mboxEntry(date, data)); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return appendLocked(path, member.Bytes())
+}
+
+// sweep deletes periods past the retention, at startup and then hourly
+func (j *mailJournal) sweep() {
+	defer j.wg.Done()
+	ticker := time.NewTicker(journalSweepInterval)
+	defer ticker.Stop()
+	for {
+		j.expire(time.Now())
+		select {
+		case <-ticker.C:
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// expire deletes the Maildirs and mbox files of periods that ended more than
+// retention_days before now
+func (j *mailJournal) expire(now time.Time) {
+	entries, err := os.ReadDir(j.cfg.Dir)
+	if err != nil {
+		LogError("Journal: %v", err)
+		return
+	}
+	cutoff := now.AddDate(0, 0, -j.cfg.RetentionDays)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".mbox.gz")
+		start, err := time.ParseInLocation(j.layout, name, now.Location())
+		if err != nil {
+			continue
+		}
+		end := start.AddDate(0, 0, 1)
+		if j.cfg.Rotate == "monthly" {
+			end = start.AddDate(0, 1, 0)
+		}
+		if end.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(j.cfg.Dir, entry.Name())); err != nil {
+			LogError("Journal: %v", err)
+			continue
+		}
+		log.Printf("[JOURNAL] Deleted %s (older than %d days)", entry.Name(), j.cfg.RetentionDays)
+	}
+}
+
+// unstuffData turns SMTP DATA as sent by the client back into the message:
+// the final dot line is dropped and leading dots are unstuffed
+func unstuffData(data []byte) []byte {
+	data = bytes.TrimSuffix(data, []byte(".\r\n"))
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		out.Write(bytes.TrimPrefix(line, []byte(".")))
+	}
+	return out.Bytes()
+}
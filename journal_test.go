@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestUnstuffData(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{name: "plain message", data: "Subject: a\r\n\r\nbody\r\n.\r\n", want: "Subject: a\r\n\r\nbody\r\n"},
+		{name: "leading dot", data: "Subject: a\r\n\r\n..hidden\r\n...two\r\n.\r\n", want: "Subject: a\r\n\r\n.hidden\r\n..two\r\n"},
+		{name: "dot line in body", data: "Subject: a\r\n\r\nbefore\r\n..\r\nafter\r\n.\r\n", want: "Subject: a\r\n\r\nbefore\r\n.\r\nafter\r\n"},
+		{name: "bare LF", data: "Subject: a\n\n..line\nend\n.\r\n", want: "Subject: a\n\n.line\nend\n"},
+		{name: "dot inside a line", data: "Subject: a\r\n\r\nend.\r\n.\r\n", want: "Subject: a\r\n\r\nend.\r\n"},
+		{name: "no trailing CRLF", data: "Subject: a\r\n\r\n..last", want: "Subject: a\r\n\r\n.last"},
+		{name: "empty message", data: ".\r\n", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(unstuffData([]byte(tt.data))); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errTooManyConnections      = errors.New("too many connections")
+	errTooManyConnectionsForIP = errors.New("too many connections from this address")
+	errConnectionRateExceeded  = errors.New("connection rate exceeded")
+)
+
+// rateWindow is the period over which ConnectionRatePerIP is counted
+const rateWindow = time.Minute
+
+// connLimiter enforces the global and per-client-IP connection caps and the
+// per-IP connection rate. It is shared by all local listeners.
+type connLimiter struct {
+	mu     sync.Mutex
+	cfg    LimitsConfig
+	total  int
+	perIP  map[string]int
+	recent map[string][]time.Time // accept times within rateWindow, per IP
+}
+
+func newConnLimiter(cfg LimitsConfig) *connLimiter {
+	return &connLimiter{
+		cfg:    cfg,
+		perIP:  make(map[string]int),
+		recent: make(map[string][]time.Time),
+	}
+}
+
+// acquire registers a new connection from ip, or returns the reason it must be refused.
+// Every successful acquire must be paired with release.
+func (l *connLimiter) acquire(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.cfg.ConnectionRatePerIP > 0 {
+		if len(l.recent) > 1024 {
+			l.pruneRecent(now)
+		}
+		times := pruneTimes(l.recent[ip], now)
+		if len(times) >= l.cfg.ConnectionRatePerIP {
+			l.recent[ip] = times
+			return errConnectionRateExceeded
+		}
+		l.recent[ip] = append(times, now)
+	}
+
+	if l.cfg.MaxConnections > 0 && l.total >= l.cfg.MaxConnections {
+		return errTooManyConnections
+	}
+	if l.cfg.MaxConnectionsPerIP > 0 && l.perIP[ip] >= l.cfg.MaxConnectionsPerIP {
+		return errTooManyConnectionsForIP
+	}
+
+	l.total++
+	l.perIP[ip]++
+	return nil
+}
+
+// release unregisters a connection accepted by acquire
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
+
+// pruneRecent drops rate history of addresses that have been quiet for a full window
+func (l *connLimiter) pruneRecent(now time.Time) {
+	for ip, times := range l.recent {
+		if times = pruneTimes(times, now); len(times) == 0 {
+			delete(l.recent, ip)
+		} else {
+			l.recent[ip] = times
+		}
+	}
+}
+
+func pruneTimes(times []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-rateWindow)
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// loginLimiter caps the number of simultaneous upstream logins per mailbox so a
+// burst of local clients cannot get the upstream account locked
+type loginLimiter struct {
+	mu     sync.Mutex
+	max    int
+	active map[string]int
+}
+
+func newLoginLimiter(max int) *loginLimiter {
+	return &loginLimiter{
+		max:    max,
+		active: make(map[string]int),
+	}
+}
+
+// loginKey identifies an upstream mailbox
+func loginKey(config *MailServerConfig) string {
+	return fmt.Sprintf("%s@%s", config.Username, upstreamAddr(config))
+}
+
+// acquire reserves an upstream login slot for the mailbox; it returns false
+// when the mailbox already has the maximum number of sessions
+func (l *loginLimiter) acquire(config *MailServerConfig) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := loginKey(config)
+	if l.max > 0 && l.active[key] >= l.max {
+		return false
+	}
+	l.active[key]++
+	return true
+}
+
+// release frees a slot reserved by acquire
+func (l *loginLimiter) release(config *MailServerConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := loginKey(config)
+	if l.active[key] <= 1 {
+		delete(l.active, key)
+	} else {
+		l.active[key]--
+	}
+}
+
+// sharedState holds the components that all local listeners use together
+type sharedState struct {
+	conns       *connLimiter
+	logins      *loginLimiter
+	guard       *authGuard
+	userFilters map[string]*ipFilter // by lower-case local username
+	imap        *imapPool            // authenticated upstream IMAP connections reused across POP3 sessions
+	cache       *messageCache        // fetched messages on disk; nil when disabled
+	journal     *mailJournal         // copies of sent and retrieved messages; nil when disabled
+	watch       *mailboxWatcher      // IDLE watches of configured mailboxes
+	sent        *sentCopier          // copies of sent messages for Sent folders
+	fetch       *fetchRunner         // scheduled fetch jobs
+	queue       *outboundQueue       // store-and-forward spool for SMTP; nil when relaying synchronously
+	sockets     *activatedSockets    // listening sockets from systemd, if socket-activated
+}
+
+func newSharedState(config *Config) (*sharedState, error) {
+	guard, err := newAuthGuard(config.AuthGuard)
+	if err != nil {
+		return nil, err
+	}
+	userFilters := make(map[string]*ipFilter)
+	for _, user := range config.Local.Users {
+		filter, err := newIPFilter(user.Allow, user.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("local user %q: %w", user.Username, err)
+		}
+		userFilters[strings.ToLower(user.Username)] = filter
+	}
+	cache, err := newMessageCache(config.Cache)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := newMailJournal(config.Journal)
+	if err != nil {
+		return nil, err
+	}
+	logins := newLoginLimiter(config.Limits.MaxUpstreamLogins)
+	pool := newIMAPPool(config.IMAPPool, config.Timeouts, logins)
+	sent := newSentCopier(pool)
+	queue, err := newOutboundQueue(config, logins, pool, sent)
+	if err != nil {
+		return nil, err
+	}
+	return &sharedState{
+		conns:       newConnLimiter(config.Limits),
+		logins:      logins,
+		guard:       guard,
+		userFilters: userFilters,
+		imap:        pool,
+		cache:       cache,
+		journal:     journal,
+		watch:       newMailboxWatcher(config, logins, cache),
+		sent:        sent,
+		fetch:       newFetchRunner(config, pool, logins),
+		queue:       queue,
+	}, nil
+}
+
+// userPermits reports whether a local user may log in from ip.
+// Logins that are not configured local users are not restricted here.
+func (st *sharedState) userPermits(username, ip string) bool {
+	return st.userFilters[strings.ToLower(username)].permits(ip)
+}
+
+// clientIP returns the IP part of a connection's remote address
+func clientIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// rejectConnection sends a final reply to a refused client and closes the connection
+func rejectConnection(conn net.Conn, reply string) {
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "%s\r\n", reply)
+	conn.Close()
+}
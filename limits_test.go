@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnLimiterGlobalCap(t *testing.T) {
+	l := newConnLimiter(LimitsConfig{MaxConnections: 2})
+	if err := l.acquire("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire("192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire("192.0.2.3"); err != errTooManyConnections {
+		t.Fatalf("third connection: got %v, want %v", err, errTooManyConnections)
+	}
+	l.release("192.0.2.1")
+	if err := l.acquire("192.0.2.3"); err != nil {
+		t.Fatalf("after a release: %v", err)
+	}
+}
+
+func TestConnLimiterPerIPCap(t *testing.T) {
+	l := newConnLimiter(LimitsConfig{MaxConnectionsPerIP: 2})
+	for i := 0; i < 2; i++ {
+		if err := l.acquire("192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.acquire("192.0.2.1"); err != errTooManyConnectionsForIP {
+		t.Fatalf("got %v, want %v", err, errTooManyConnectionsForIP)
+	}
+	// Other addresses have their own count
+	if err := l.acquire("192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	l.release("192.0.2.1")
+	if err := l.acquire("192.0.2.1"); err != nil {
+		t.Fatalf("after a release: %v", err)
+	}
+	l.release("192.0.2.1")
+	l.release("192.0.2.1")
+	l.release("192.0.2.2")
+	if l.total != 0 || len(l.perIP) != 0 {
+		t.Errorf("after releasing everything: total %d, per IP %v", l.total, l.perIP)
+	}
+}
+
+func TestConnLimiterRateWindow(t *testing.T) {
+	l := newConnLimiter(LimitsConfig{ConnectionRatePerIP: 2})
+	for i := 0; i < 2; i++ {
+		if err := l.acquire("192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+		l.release("192.0.2.1")
+	}
+	// Released connections still count against the rate
+	if err := l.acquire("192.0.2.1"); err != errConnectionRateExceeded {
+		t.Fatalf("got %v, want %v", err, errConnectionRateExceeded)
+	}
+	if err := l.acquire("192.0.2.2"); err != nil {
+		t.Fatalf("another address: %v", err)
+	}
+
+	// Once the first connection is older than the window, one more is allowed
+	l.recent["192.0.2.1"][0] = time.Now().Add(-rateWindow - time.Second)
+	if err := l.acquire("192.0.2.1"); err != nil {
+		t.Fatalf("after the window rolled over: %v", err)
+	}
+	if err := l.acquire("192.0.2.1"); err != errConnectionRateExceeded {
+		t.Fatalf("got %v, want %v", err, errConnectionRateExceeded)
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	a := &MailServerConfig{Host: "imap.example.com", Port: 993, Username: "a@example.com"}
+	b := &MailServerConfig{Host: "imap.example.com", Port: 993, Username: "b@example.com"}
+	l := newLoginLimiter(1)
+	if !l.acquire(a) {
+		t.Fatal("first login refused")
+	}
+	if l.acquire(a) {
+		t.Fatal("second login to the same mailbox allowed")
+	}
+	if !l.acquire(b) {
+		t.Fatal("login to another mailbox refused")
+	}
+	l.release(a)
+	if !l.acquire(a) {
+		t.Fatal("login refused after a release")
+	}
+
+	unlimited := newLoginLimiter(0)
+	for i := 0; i < 10; i++ {
+		if !unlimited.acquire(a) {
+			t.Fatalf("login %d refused without a limit", i+1)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// localTLSHandshakeTimeout bounds implicit TLS and STARTTLS/STLS handshakes
+// with local clients
+const localTLSHandshakeTimeout = 30 * time.Second
+
+// localTLSConfig loads the certificate a listener presents to local clients.
+// It returns nil when the listener offers no TLS at all.
+func localTLSConfig(cfg ListenerConfig) (*tls.Config, error) {
+	if !cfg.UseTLS && !cfg.StartTLS {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate for listener %s: %w", cfg.Name, err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// listenLocal opens the TCP listener for a local POP3/SMTP endpoint, or takes
+// over the matching socket passed by systemd socket activation
+func listenLocal(cfg ListenerConfig, sockets *activatedSockets) (net.Listener, error) {
+	if listener := sockets.take(cfg); listener != nil {
+		return listener, nil
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	return net.Listen("tcp", addr)
+}
+
+// readClientProxy consumes the PROXY protocol header of a freshly accepted
+// connection, so RemoteAddr is the real client
+func readClientProxy(conn net.Conn, cfg ListenerConfig, proxyTrusted cidrList) (net.Conn, error) {
+	if cfg.ProxyProtocol == "required" || cfg.ProxyProtocol == "optional" {
+		peer := clientIP(conn)
+		if proxyTrusted.contains(peer) {
+			proxied, err := readProxyHeader(conn)
+			if err != nil {
+				return nil, fmt.Errorf("PROXY protocol from %s: %w", peer, err)
+			}
+			conn = proxied
+		} else if cfg.ProxyProtocol == "required" {
+			return nil, fmt.Errorf("connection from %s is not from a trusted proxy", peer)
+		}
+	}
+	return conn, nil
+}
+
+// startClientTLS completes the implicit TLS handshake on use_tls listeners, so
+// a client that never sends a ClientHello cannot hold the connection open
+func startClientTLS(conn net.Conn, cfg ListenerConfig, tlsConfig *tls.Config) (net.Conn, error) {
+	if cfg.UseTLS {
+		tlsConn := tls.Server(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(localTLSHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("TLS handshake with %s failed: %w", clientIP(conn), err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// isTLSConn reports whether a local client connection is encrypted
+func isTLSConn(conn net.Conn) bool {
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
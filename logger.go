@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"strings"
+	"sync/atomic"
 )
 
 type LogLevel int
@@ -12,17 +13,18 @@ const (
 	LogLevelDebug
 )
 
-var currentLogLevel = LogLevelInfo
+// currentLogLevel holds a LogLevel; it is atomic because a reload can change it at runtime
+var currentLogLevel atomic.Int32
 
 // SetLogLevel configures the logging level
 func SetLogLevel(level string) {
 	switch strings.ToLower(level) {
 	case "debug":
-		currentLogLevel = LogLevelDebug
+		currentLogLevel.Store(int32(LogLevelDebug))
 	case "info", "":
-		currentLogLevel = LogLevelInfo
+		currentLogLevel.Store(int32(LogLevelInfo))
 	default:
-		currentLogLevel = LogLevelInfo
+		currentLogLevel.Store(int32(LogLevelInfo))
 	}
 }
 
@@ -33,11 +35,16 @@ func LogInfo(format string, args ...interface{}) {
 
 // LogDebug logs detailed protocol exchanges (only shown in debug mode)
 func LogDebug(format string, args ...interface{}) {
-	if currentLogLevel >= LogLevelDebug {
+	if LogLevel(currentLogLevel.Load()) >= LogLevelDebug {
 		log.Printf("[DEBUG] "+format, args...)
 	}
 }
 
+// LogWarn logs problems the service works around (always shown)
+func LogWarn(format string, args ...interface{}) {
+	log.Printf("[WARN] "+format, args...)
+}
+
 // LogError logs errors (always shown)
 func LogError(format string, args ...interface{}) {
 	log.Printf("[ERROR] "+format, args...)
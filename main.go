@@ -11,6 +11,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExport(os.Args[2:]))
+	}
+
 	configPath := flag.String("config", "config.yaml", "Path to configuration file")
 	flag.Parse()
 
@@ -34,24 +38,58 @@ func main() {
 	}
 
 	log.Println("Email proxy service started successfully")
+	if err := sdNotify("READY=1"); err != nil {
+		LogError("%v", err)
+	}
+	stopWatchdog := make(chan struct{})
+	go runWatchdog(stopWatchdog)
 
-	// Wait for shutdown signal
+	// Wait for shutdown signal; SIGHUP reloads the configuration
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig == syscall.SIGHUP {
+			reloadConfig(*configPath, cfg)
+			continue
+		}
+		break
+	}
 
 	log.Println("Shutting down email proxy service...")
+	sdNotify("STOPPING=1")
+	close(stopWatchdog)
 	proxyService.Stop()
 	log.Println("Email proxy service stopped")
 }
 
+// reloadConfig re-reads the configuration file on SIGHUP. Only the log level is
+// applied to the running service; changes to any other section of running are
+// logged as ignored, since they need a restart.
+func reloadConfig(path string, running *Config) {
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		LogError("Reload failed, keeping the running configuration: %v", err)
+		return
+	}
+	SetLogLevel(cfg.LogLevel)
+	LogInfo("Configuration reloaded, log level: %s", strings.ToLower(cfg.LogLevel))
+	if changed := running.changedSections(cfg); len(changed) > 0 {
+		LogWarn("Reload ignored changes to %s; restart to apply them", strings.Join(changed, ", "))
+	}
+}
+
 type ProxyService struct {
 	config  *Config
+	shared  *sharedState
 	servers []Server
 	wg      sync.WaitGroup
 }
 
 type Server interface {
+	Listen() error // binds the socket; Start then serves clients until Stop
 	Start() error
 	Stop() error
 }
@@ -63,37 +101,44 @@ func NewProxyService(config *Config) *ProxyService {
 }
 
 func (ps *ProxyService) Start() error {
-	// Start POP3 proxy if configured
-	if ps.config.Local.POP3.Port > 0 {
-		pop3Server := NewPOP3Server(ps.config)
-		ps.servers = append(ps.servers, pop3Server)
-		ps.wg.Add(1)
-		go func() {
-			defer ps.wg.Done()
-			if err := pop3Server.Start(); err != nil {
-				log.Printf("POP3 server error: %v", err)
-			}
-		}()
-		log.Printf("Started POP3 proxy server on port %d", ps.config.Local.POP3.Port)
-	} else {
-		log.Printf("POP3 proxy server disabled (port not configured)")
+	shared, err := newSharedState(ps.config)
+	if err != nil {
+		return err
+	}
+	ps.shared = shared
+	if ps.shared.sockets, err = systemdSockets(); err != nil {
+		return err
 	}
 
-	// Start SMTP proxy if configured
-	if ps.config.Local.SMTP != nil && ps.config.Local.SMTP.Port > 0 {
-		smtpServer := NewSMTPServer(ps.config)
-		ps.servers = append(ps.servers, smtpServer)
+	// Start every configured local listener, each with its own policy
+	listeners := ps.config.Local.AllListeners()
+	if len(listeners) == 0 {
+		log.Printf("No local listeners configured (set a port for local.pop3, local.smtp or local.listeners)")
+	}
+	for _, listenerConfig := range listeners {
+		var server Server
+		switch listenerConfig.Protocol {
+		case "pop3":
+			server = NewPOP3Server(ps.config, listenerConfig, ps.shared)
+		case "smtp":
+			server = NewSMTPServer(ps.config, listenerConfig, ps.shared)
+		}
+		if err := server.Listen(); err != nil {
+			log.Printf("Listener %s error: %v", listenerConfig.Name, err)
+			continue
+		}
+		ps.servers = append(ps.servers, server)
 		ps.wg.Add(1)
-		go func() {
+		go func(name string) {
 			defer ps.wg.Done()
-			if err := smtpServer.Start(); err != nil {
-				log.Printf("SMTP server error: %v", err)
+			if err := server.Start(); err != nil {
+				log.Printf("Listener %s error: %v", name, err)
 			}
-		}()
-		log.Printf("Started SMTP proxy server on port %d", ps.config.Local.SMTP.Port)
-	} else {
-		log.Printf("SMTP proxy server disabled (not configured or port not set)")
+		}(listenerConfig.Name)
+		log.Printf("Started %s proxy server %s on port %d", strings.ToUpper(listenerConfig.Protocol),
+			listenerConfig.Name, listenerConfig.Port)
 	}
+	ps.shared.sockets.closeUnused()
 
 	// Service capabilities summary
 	log.Printf("Proxy-Mail service supports:")
@@ -111,5 +156,13 @@ func (ps *ProxyService) Stop() {
 		server.Stop()
 	}
 	ps.wg.Wait()
+	if ps.shared != nil {
+		ps.shared.fetch.close()
+		ps.shared.watch.close()
+		ps.shared.queue.close()
+		ps.shared.sent.close()
+		ps.shared.imap.close()
+		ps.shared.journal.close()
+	}
 }
 
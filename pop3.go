@@ -2,40 +2,81 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type POP3Server struct {
-	config   *Config
-	listener net.Listener
-	wg       sync.WaitGroup
-	stopping bool
+	config         *Config
+	listenerConfig ListenerConfig
+	shared         *sharedState
+	filter         *ipFilter
+	proxyTrusted   cidrList
+	tlsConfig      *tls.Config
+	listener       net.Listener
+	wg             sync.WaitGroup
+	stopping       bool
 }
 
-func NewPOP3Server(config *Config) *POP3Server {
+func NewPOP3Server(config *Config, listenerConfig ListenerConfig, shared *sharedState) *POP3Server {
 	return &POP3Server{
-		config: config,
+		config:         config,
+		listenerConfig: listenerConfig,
+		shared:         shared,
 	}
 }
 
-func (s *POP3Server) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.config.Local.POP3.Host, s.config.Local.POP3.Port)
-	listener, err := net.Listen("tcp", addr)
+// Listen prepares the listener's policy and binds its socket, so that the
+// service can report readiness before Start begins accepting clients
+func (s *POP3Server) Listen() error {
+	filter, err := newIPFilter(s.listenerConfig.Allow, s.listenerConfig.Deny)
+	if err != nil {
+		return fmt.Errorf("invalid client networks for listener %s: %w", s.listenerConfig.Name, err)
+	}
+	s.filter = filter
+
+	s.proxyTrusted, err = parseCIDRList(s.listenerConfig.ProxyTrusted)
+	if err != nil {
+		return fmt.Errorf("invalid proxy_trusted networks for listener %s: %w", s.listenerConfig.Name, err)
+	}
+
+	s.tlsConfig, err = localTLSConfig(s.listenerConfig)
 	if err != nil {
-		return fmt.Errorf("failed to start POP3 server on %s: %w", addr, err)
+		return err
+	}
+
+	listener, err := listenLocal(s.listenerConfig, s.shared.sockets)
+	if err != nil {
+		return fmt.Errorf("failed to start POP3 server %s: %w", s.listenerConfig.Name, err)
 	}
 
 	s.listener = listener
-	log.Printf("POP3 proxy server listening on %s", addr)
+	log.Printf("POP3 proxy server %s listening on %s (TLS: %v, STLS: %v)", s.listenerConfig.Name,
+		listener.Addr(), s.listenerConfig.UseTLS, s.listenerConfig.StartTLS)
+	return nil
+}
+
+// Start accepts clients until Stop is called
+func (s *POP3Server) Start() error {
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
+	}
 
 	for !s.stopping {
-		conn, err := listener.Accept()
+		conn, err := s.listener.Accept()
 		if err != nil {
 			if s.stopping {
 				break
@@ -61,9 +102,41 @@ func (s *POP3Server) Stop() error {
 	return nil
 }
 
-func (s *POP3Server) handleConnection(localConn net.Conn) {
+func (s *POP3Server) handleConnection(conn net.Conn) {
 	defer s.wg.Done()
-	defer localConn.Close()
+	defer conn.Close()
+
+	// Admission checks run after the PROXY header so they see the real client.
+	// The allow/deny lists come first: denied clients get neither a TLS
+	// handshake nor a connection slot.
+	localConn, err := readClientProxy(conn, s.listenerConfig, s.proxyTrusted)
+	if err != nil {
+		LogInfo("[POP3] Dropping connection on %s: %v", s.listenerConfig.Name, err)
+		return
+	}
+	ip := clientIP(localConn)
+	if !s.filter.permits(ip) {
+		LogInfo("[POP3] Refusing client %s: address not allowed", localConn.RemoteAddr())
+		if !s.listenerConfig.UseTLS { // a TLS client could not read a plain-text reply
+			rejectConnection(localConn, "-ERR Access denied")
+		}
+		return
+	}
+	if localConn, err = startClientTLS(localConn, s.listenerConfig, s.tlsConfig); err != nil {
+		LogInfo("[POP3] Dropping connection on %s: %v", s.listenerConfig.Name, err)
+		return
+	}
+	if s.shared.guard.bannedIP(ip) {
+		LogInfo("[POP3] Refusing connection from banned address %s", localConn.RemoteAddr())
+		rejectConnection(localConn, "-ERR [AUTH] Too many failed logins, try again later")
+		return
+	}
+	if err := s.shared.conns.acquire(ip); err != nil {
+		LogInfo("[POP3] Refusing connection from %s: %v", localConn.RemoteAddr(), err)
+		rejectConnection(localConn, "-ERR [SYS/TEMP] Too many connections, try again later")
+		return
+	}
+	defer s.shared.conns.release(ip)
 
 	clientAddr := localConn.RemoteAddr().String()
 	log.Printf("[POP3] Client connected from %s", clientAddr)
@@ -75,6 +148,9 @@ func (s *POP3Server) handleConnection(localConn net.Conn) {
 func (s *POP3Server) findServerConfigByUsername(username string) *ServerConfig {
 	// First try exact match
 	for _, server := range s.config.Servers {
+		if !s.listenerConfig.AllowsServer(server.Name) {
+			continue
+		}
 		if (server.POP3 != nil && server.POP3.Username == username) ||
 		   (server.IMAP != nil && server.IMAP.Username == username) {
 			return &server
@@ -129,28 +205,314 @@ func (s *POP3Server) handlePOP3Backend(localConn, upstreamConn net.Conn, upstrea
 	log.Printf("[POP3] Client %s disconnected from POP3 mailbox %s", clientAddr, upstreamConfig.Username)
 }
 
+// maildropAccount is one upstream mailbox of a POP3 session. A local user with
+// several servers sees the messages of all of them as one maildrop.
+type maildropAccount struct {
+	server     string // ServerConfig name
+	config     *MailServerConfig
+	upstream   *imapClient
+	uidlPrefix string // namespaces UIDL in an aggregated maildrop; empty otherwise
+}
+
+// maildropMessage is a message of the POP3 maildrop and the account it is in
+type maildropMessage struct {
+	IMAPMessage
+	account *maildropAccount
+}
+
+// messageCacheKey names the folder of a message in the message cache; messages
+// without UIDVALIDITY are not cached, since their UIDs may be reused
+func messageCacheKey(msg maildropMessage) string {
+	if msg.UIDValidity == 0 {
+		return ""
+	}
+	return loginKey(msg.account.config) + "/" + msg.Folder
+}
+
+// messageUIDL returns the unique-id of a message: UIDVALIDITY and UID, prefixed
+// with a short hash of the folder for folders other than INBOX and with a short
+// hash of the server name in aggregated maildrops
+func messageUIDL(msg maildropMessage) string {
+	uidl := fmt.Sprintf("%d.%d", msg.UIDValidity, msg.UID)
+	if !strings.EqualFold(msg.Folder, "INBOX") {
+		uidl = shortHash(msg.Folder) + "." + uidl
+	}
+	return msg.account.uidlPrefix + uidl
+}
+
+// shortHash returns 8 hex digits identifying a name in UIDL values
+func shortHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:4])
+}
+
+// messageSize returns the size reported by LIST and STAT: exact for cached
+// messages, otherwise the server's RFC822.SIZE
+func (s *POP3Server) messageSize(msg maildropMessage) int {
+	if size, ok := s.shared.cache.size(messageCacheKey(msg), msg.UIDValidity, msg.UID); ok {
+		return int(size)
+	}
+	return msg.Size
+}
+
+// loadMessage returns a message from the cache, fetching and caching it on a miss
+func (s *POP3Server) loadMessage(msg maildropMessage) ([]byte, error) {
+	key := messageCacheKey(msg)
+	if data := s.shared.cache.get(key, msg.UIDValidity, msg.UID); data != nil {
+		LogDebug("Message UID %d served from cache", msg.UID)
+		return data, nil
+	}
+	upstream := msg.account.upstream
+	if err := upstream.selectFolder(msg.Folder); err != nil {
+		return nil, err
+	}
+	data, err := upstream.fetchMessage(msg.UID)
+	if err != nil {
+		return nil, err
+	}
+	s.shared.cache.put(key, msg.UIDValidity, msg.UID, data)
+	return data, nil
+}
+
+// loadTop returns enough of a message for TOP: the cached message when there is
+// one, otherwise the header and the first body lines fetched with partial fetches.
+// Partial messages are not cached.
+func (s *POP3Server) loadTop(msg maildropMessage, bodyLines int) ([]byte, error) {
+	if data := s.shared.cache.get(messageCacheKey(msg), msg.UIDValidity, msg.UID); data != nil {
+		LogDebug("Message UID %d served from cache", msg.UID)
+		return data, nil
+	}
+	upstream := msg.account.upstream
+	if err := upstream.selectFolder(msg.Folder); err != nil {
+		return nil, err
+	}
+	return upstream.fetchTop(msg.UID, bodyLines, msg.Size)
+}
+
+// mailboxFolders returns the IMAP folders a POP3 login sees as one mailbox: the
+// folder named in the login suffix, else the folders of the local user, else
+// those of the upstream server, else INBOX
+func mailboxFolders(config *MailServerConfig, localUser *LocalUserConfig, suffix string) []string {
+	switch {
+	case suffix != "":
+		return []string{suffix}
+	case localUser != nil && len(localUser.Folders) > 0:
+		return localUser.Folders
+	case len(config.Folders) > 0:
+		return config.Folders
+	}
+	return []string{"INBOX"}
+}
+
+// mailboxView returns the view filter of a POP3 login: the local user's,
+// otherwise the upstream server's; nil shows every message
+func mailboxView(config *MailServerConfig, localUser *LocalUserConfig) *ViewConfig {
+	if localUser != nil && localUser.View != nil {
+		return localUser.View
+	}
+	return config.View
+}
+
+// splitFolderSuffix splits a login such as "user@example.com+Junk" into the
+// username and the folder to open
+func splitFolderSuffix(login string) (string, string) {
+	i := strings.LastIndexByte(login, '+')
+	if i <= 0 || i == len(login)-1 || strings.ContainsRune(login[i:], '@') {
+		return login, ""
+	}
+	return login[:i], login[i+1:]
+}
+
+// writeMessage sends a message as a POP3 multi-line response body, including
+// the terminating ".". With bodyLines >= 0 only the header and that many body
+// lines are sent (TOP).
+func writeMessage(w io.Writer, data []byte, bodyLines int) error {
+	mw := newMessageWriter(w, bodyLines)
+	mw.Write(data)
+	return mw.Close()
+}
+
+// messageWriter encodes a message as a POP3 multi-line response (RFC 1939 3)
+// while it is written: line endings become CRLF, lines starting with "." get
+// another ".", and all other bytes pass through unchanged. Close ends the
+// response with ".".
+type messageWriter struct {
+	out       *bufio.Writer
+	bodyLines int  // body lines left to send for TOP, or -1 for all
+	inBody    bool // the blank line after the header was sent
+	lineStart bool // nothing of the current line was sent yet
+	pendingCR bool // a CR was read; it ends the line if LF follows
+	done      bool // TOP has sent all requested lines; the rest is dropped
+	err       error
+}
+
+func newMessageWriter(w io.Writer, bodyLines int) *messageWriter {
+	return &messageWriter{out: bufio.NewWriter(w), bodyLines: bodyLines, lineStart: true}
+}
+
+func (m *messageWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if m.done || m.err != nil {
+			break
+		}
+		switch {
+		case b == '\n':
+			m.pendingCR = false
+			m.endLine()
+		case b == '\r':
+			if m.pendingCR {
+				m.writeByte('\r') // bare CR inside the line
+			}
+			m.pendingCR = true
+		default:
+			if m.pendingCR {
+				m.writeByte('\r')
+				m.pendingCR = false
+			}
+			if m.lineStart && b == '.' {
+				m.writeByte('.')
+			}
+			m.writeByte(b)
+		}
+	}
+	return len(p), m.err
+}
+
+// endLine writes CRLF and counts body lines for TOP
+func (m *messageWriter) endLine() {
+	blank := m.lineStart
+	m.out.WriteString("\r\n")
+	m.lineStart = true
+	switch {
+	case !m.inBody && blank:
+		m.inBody = true
+	case m.inBody && m.bodyLines > 0:
+		m.bodyLines--
+	default:
+		return
+	}
+	if m.inBody && m.bodyLines == 0 {
+		m.done = true
+	}
+}
+
+func (m *messageWriter) writeByte(b byte) {
+	if err := m.out.WriteByte(b); err != nil && m.err == nil {
+		m.err = err
+	}
+	m.lineStart = false
+}
+
+// Close terminates an unterminated last line and writes the final "."
+func (m *messageWriter) Close() error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.pendingCR && !m.done {
+		m.writeByte('\r')
+	}
+	if !m.lineStart {
+		m.out.WriteString("\r\n")
+	}
+	m.out.WriteString(".\r\n")
+	return m.out.Flush()
+}
+
+// applyDeletions commits the DELE marks of a session according to the
+// delete_mode of each account, folder by folder
+func (s *POP3Server) applyDeletions(messages []maildropMessage, deleted map[int]bool) error {
+	msgNums := make([]int, 0, len(deleted))
+	for msgNum := range deleted {
+		msgNums = append(msgNums, msgNum)
+	}
+	sort.Ints(msgNums)
+	type folderKey struct {
+		account *maildropAccount
+		folder  string
+	}
+	var folders []folderKey
+	uids := make(map[folderKey][]int)
+	for _, msgNum := range msgNums {
+		msg := messages[msgNum-1]
+		key := folderKey{msg.account, msg.Folder}
+		if _, ok := uids[key]; !ok {
+			folders = append(folders, key)
+		}
+		uids[key] = append(uids[key], msg.UID)
+	}
+
+	for _, key := range folders {
+		upstream := key.account.upstream
+		if err := upstream.selectFolder(key.folder); err != nil {
+			return err
+		}
+		if err := deleteInFolder(upstream, key.account.config, uids[key]); err != nil {
+			return fmt.Errorf("%s %s: %w", key.account.server, key.folder, err)
+		}
+	}
+	return nil
+}
+
+// deleteInFolder applies delete_mode to messages of the selected folder
+func deleteInFolder(upstream *imapClient, config *MailServerConfig, uids []int) error {
+	if config.MarkSeen == "dele" {
+		// Before moving, so the copy in the target folder is marked too
+		if err := upstream.markSeen(uids...); err != nil {
+			return err
+		}
+	}
+	switch config.DeleteMode {
+	case "move":
+		return upstream.moveUIDs(uids, config.DeleteFolder)
+	case "gmail_archive":
+		return upstream.removeInboxLabel(uids)
+	case "keep":
+		return nil
+	default:
+		return upstream.expungeUIDs(uids)
+	}
+}
+
+// reportUpstreamFailure tells the client that the upstream server stopped
+// answering; the session cannot continue after this
+func (s *POP3Server) reportUpstreamFailure(localConn net.Conn, clientAddr string, err error) {
+	if isTimeout(err) {
+		LogError("[POP3] Upstream server timed out for client %s: %v", clientAddr, err)
+		fmt.Fprintf(localConn, "-ERR [SYS/TEMP] Mail server not responding\r\n")
+		return
+	}
+	LogError("[POP3] Lost upstream connection for client %s: %v", clientAddr, err)
+	fmt.Fprintf(localConn, "-ERR [SYS/TEMP] Lost connection to mail server\r\n")
+}
+
 func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 	log.Printf("[POP3] Starting POP3-to-IMAP translation for client %s", clientAddr)
 
 	// IMAP session state
-	var imapTag int = 1000
-	var authenticated bool = false
 	var selectedMailbox bool = false
 	var messageCount int = 0
-	var messages []IMAPMessage
+	var messages []maildropMessage // of all accounts and folders shown to the client, in order
+	var folderSuffix string    // folder named in the login, e.g. "Junk" in "user@example.com+Junk"
+	deleted := make(map[int]bool) // DELE marks, applied upstream only at QUIT (RFC 1939 UPDATE state)
 
 	// Adding user-specific state
 	var clientUsername string
+	var loginName string // the user clientUsername resolves to, without a "+Folder" suffix
 	var serverConfig *ServerConfig
+	var localUser *LocalUserConfig
+	ip := clientIP(localConn)
 
 	// POP3 session state
 	var pop3State string = "AUTHORIZATION" // AUTHORIZATION, TRANSACTION, UPDATE
 
-	// Create a placeholder to store the upstream connection and scanner
-	var upstreamConn net.Conn
-	var upstreamConfig *MailServerConfig
-	var protocol string
-	var scanner *bufio.Scanner     // Add scanner at function level
+	// Upstream IMAP connections, leased from the pool at PASS and handed back when the session ends
+	var accounts []*maildropAccount
+	var upstreamConfig *MailServerConfig // of the first account, for log lines
+	defer func() {
+		for _, account := range accounts {
+			s.shared.imap.put(account.upstream)
+		}
+	}()
 
 	// Send POP3 greeting to client
 	fmt.Fprintf(localConn, "+OK POP3 server ready (IMAP backend)\r\n")
@@ -159,11 +521,16 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 	// Handle POP3 commands and translate to IMAP
 	clientReader := bufio.NewReader(localConn)
 	for {
+		// RFC 1939 autologout timer: restarted for every command
+		localConn.SetReadDeadline(time.Now().Add(s.config.Timeouts.POP3Idle))
+
 		// Read line as raw bytes to preserve encoding
 		lineBytes, err := clientReader.ReadBytes('\n')
 		if err != nil {
-			if upstreamConn != nil {
-				upstreamConn.Close()
+			if isTimeout(err) {
+				fmt.Fprintf(localConn, "-ERR Autologout; idle for too long\r\n")
+				log.Printf("[POP3] Client %s idle for more than %v, closing connection", clientAddr, s.config.Timeouts.POP3Idle)
+				return
 			}
 			// Safe logging that handles nil upstreamConfig
 			if upstreamConfig != nil {
@@ -200,15 +567,50 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 				continue
 			}
 
+			if s.listenerConfig.RequireTLS && !isTLSConn(localConn) {
+				fmt.Fprintf(localConn, "-ERR [AUTH] Must issue STLS command first\r\n")
+				continue
+			}
+
 			// Store username as provided by client (preserve case)
 			clientUsername = strings.TrimSpace(line[5:]) // Get original case username by skipping "USER "
+
+			// "user+Folder" opens that folder instead of the configured ones,
+			// unless the full login is itself a known username
+			lookupName := clientUsername
+			folderSuffix = ""
+			if s.config.FindLocalUser(clientUsername) == nil && s.findServerConfigByUsername(clientUsername) == nil {
+				lookupName, folderSuffix = splitFolderSuffix(clientUsername)
+			}
+
+			// Configured local users reach their own server and must know their local password
+			localUser = s.config.FindLocalUser(lookupName)
+			loginName = lookupName
+			if localUser != nil {
+				loginName = localUser.Username
+				serverConfig = s.config.GetServerByName(localUser.Server)
+				for _, name := range localUser.MaildropServers() {
+					if !s.listenerConfig.AllowsServer(name) {
+						serverConfig = nil
+					}
+				}
+			} else if s.listenerConfig.RequireAuth {
+				// Only local users with a local password may use this listener
+				serverConfig = nil
+				fmt.Fprintf(localConn, "-ERR Invalid username\r\n")
+				log.Printf("[POP3] Listener %s requires a local user, rejecting username: %s", s.listenerConfig.Name, clientUsername)
+				continue
+			} else {
+				// Try to find exact match first
+				serverConfig = s.findServerConfigByUsername(lookupName)
+			}
 			
-			// Try to find exact match first
-			serverConfig = s.findServerConfigByUsername(clientUsername)
-			
-			if serverConfig == nil {
+			if serverConfig == nil && localUser == nil {
 				// If no exact match, try to find any available server with IMAP/POP3
 				for _, server := range s.config.Servers {
+					if !s.listenerConfig.AllowsServer(server.Name) {
+						continue
+					}
 					if server.IMAP != nil || server.POP3 != nil {
 						serverConfig = &server
 						log.Printf("[POP3] Using server config '%s' for username: %s", server.Name, clientUsername)
@@ -221,6 +623,11 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 					log.Printf("[POP3] No server configuration found for username: %s", clientUsername)
 					continue
 				}
+			} else if serverConfig == nil {
+				fmt.Fprintf(localConn, "-ERR Invalid username\r\n")
+				log.Printf("[POP3] Local user %s cannot use listener %s", clientUsername, s.listenerConfig.Name)
+				localUser = nil
+				continue
 			} else {
 				log.Printf("[POP3] Found matching server config '%s' for username: %s", serverConfig.Name, clientUsername)
 			}
@@ -239,122 +646,132 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 				continue
 			}
 
-			// Get the correct upstream config
-			upstreamConfig = serverConfig.IMAP
-			protocol = "IMAP"
-			if upstreamConfig == nil {
-				upstreamConfig = serverConfig.POP3
-				protocol = "POP3"
+			// Bans and access lists apply to the user, whatever folder suffix the login names
+			if s.shared.guard.banned(ip, loginName) {
+				fmt.Fprintf(localConn, "-ERR [AUTH] Too many failed logins, try again later\r\n")
+				log.Printf("[POP3] Refusing banned login %s from %s", clientUsername, clientAddr)
+				return
 			}
 
-			if upstreamConn == nil {
-				// Connect to upstream server
-				upstreamAddr := fmt.Sprintf("%s:%d", upstreamConfig.Host, upstreamConfig.Port)
-				var err error
-				if upstreamConfig.UseTLS {
-					upstreamConn, err = tls.Dial("tcp", upstreamAddr, &tls.Config{ServerName: upstreamConfig.Host})
-				} else {
-					upstreamConn, err = net.Dial("tcp", upstreamAddr)
+			if !s.shared.userPermits(loginName, ip) {
+				fmt.Fprintf(localConn, "-ERR [AUTH] Access denied from this address\r\n")
+				log.Printf("[POP3] Local user %s may not log in from %s", clientUsername, clientAddr)
+				return
+			}
+
+			if localUser != nil {
+				password := ""
+				if len(line) > 5 {
+					password = line[5:]
 				}
-				if err != nil {
-					log.Printf("[POP3] ERROR: Failed to connect to upstream %s server %s for mailbox %s: %v", 
-						protocol, upstreamAddr, upstreamConfig.Username, err)
-					fmt.Fprintf(localConn, "-ERR Cannot connect to mail server\r\n")
-					return
+				if !passwordsEqual(localUser.Password, password) {
+					time.Sleep(s.shared.guard.failure(ip, loginName, "POP3"))
+					fmt.Fprintf(localConn, "-ERR [AUTH] Authentication failed\r\n")
+					log.Printf("[POP3] PROXY -> CLIENT (%s): -ERR [AUTH] Authentication failed for local user %s", clientAddr, clientUsername)
+					// RFC 1939: the client may start over with USER
+					serverConfig = nil
+					localUser = nil
+					continue
 				}
-				defer upstreamConn.Close()
-
-				log.Printf("[POP3] Successfully connected to upstream %s server %s for %s using account %s", 
-					protocol, upstreamAddr, clientUsername, upstreamConfig.Username)
-
-				// Initialize scanner for upstream responses
-				scanner = bufio.NewScanner(upstreamConn)
+				s.shared.guard.success(ip, loginName)
+			}
 
-				// Read initial greeting from IMAP server
-				if scanner.Scan() {
-					greeting := scanner.Text()
-					log.Printf("[POP3] IMAP-SERVER -> PROXY (%s): %s", clientAddr, greeting)
+			if accounts == nil {
+				servers := []*ServerConfig{serverConfig}
+				if localUser != nil && len(localUser.Servers) > 1 {
+					servers = servers[:0]
+					for _, name := range localUser.Servers {
+						servers = append(servers, s.config.GetServerByName(name))
+					}
 				}
-			}
-		
-			// Authenticate with IMAP using the correct credentials
-			if !authenticated {
-				imapTag++
-				// Use the correct upstream credentials
-				loginCmd := fmt.Sprintf("A%d LOGIN %s %s\r\n", imapTag, upstreamConfig.Username, upstreamConfig.Password)
-				fmt.Fprintf(upstreamConn, loginCmd)
-				log.Printf("[POP3] PROXY -> IMAP-SERVER (%s): A%d LOGIN %s [hidden]", 
-					clientAddr, imapTag, upstreamConfig.Username)
-
-				// Read IMAP response
-				for scanner.Scan() {
-					response := scanner.Text()
-					log.Printf("[POP3] IMAP-SERVER -> PROXY (%s): %s", clientAddr, response)
-					if strings.HasPrefix(response, fmt.Sprintf("A%d OK", imapTag)) {
-						authenticated = true
-						break
-					} else if strings.HasPrefix(response, fmt.Sprintf("A%d NO", imapTag)) || strings.HasPrefix(response, fmt.Sprintf("A%d BAD", imapTag)) {
-						fmt.Fprintf(localConn, "-ERR Authentication failed\r\n")
-						log.Printf("[POP3] PROXY -> CLIENT (%s): -ERR Authentication failed", clientAddr)
+				for _, server := range servers {
+					// Get the correct upstream config
+					config := server.IMAP
+					protocol := "IMAP"
+					if config == nil {
+						config = server.POP3
+						protocol = "POP3"
+					}
+
+					// Lease an authenticated connection; the pool logs in only when it has none
+					client, err := s.shared.imap.get(config, clientAddr)
+					if err != nil {
+						log.Printf("[POP3] ERROR: Failed to connect to upstream %s server for mailbox %s: %v",
+							protocol, config.Username, err)
+						switch {
+						case errors.Is(err, errUpstreamLoginLimit):
+							fmt.Fprintf(localConn, "-ERR [IN-USE] Too many sessions for this mailbox, try again later\r\n")
+						case errors.Is(err, errIMAPAuthFailed):
+							fmt.Fprintf(localConn, "-ERR Authentication failed\r\n")
+						case isTimeout(err):
+							fmt.Fprintf(localConn, "-ERR [SYS/TEMP] Mail server not responding\r\n")
+						default:
+							fmt.Fprintf(localConn, "-ERR Cannot connect to mail server\r\n")
+						}
 						return
 					}
+					account := &maildropAccount{server: server.Name, config: config, upstream: client}
+					if len(servers) > 1 {
+						account.uidlPrefix = shortHash(server.Name) + "-"
+					}
+					accounts = append(accounts, account)
+
+					log.Printf("[POP3] Using upstream %s server %s for %s with account %s",
+						protocol, upstreamAddr(config), clientUsername, config.Username)
 				}
+				upstreamConfig = accounts[0].config
 			}
 
-			if authenticated {
-				// Select INBOX
-				if !selectedMailbox {
-					imapTag++
-					selectCmd := fmt.Sprintf("A%d SELECT INBOX\r\n", imapTag)
-					fmt.Fprintf(upstreamConn, selectCmd)
-					log.Printf("[POP3] PROXY -> IMAP-SERVER (%s): A%d SELECT INBOX", clientAddr, imapTag)
-
-					// Read SELECT response
-					for scanner.Scan() {
-						response := scanner.Text()
-						log.Printf("[POP3] IMAP-SERVER -> PROXY (%s): %s", clientAddr, response)
-
-						// Parse EXISTS response
-						if strings.Contains(response, "EXISTS") {
-							fields := strings.Fields(response)
-							if len(fields) >= 2 {
-								if count, err := strconv.Atoi(fields[1]); err == nil {
-									messageCount = count
-									LogInfo("📥 INBOX: Found %d emails for %s", messageCount, upstreamConfig.Username)
-								}
-							}
+			// Select the folders and collect their messages
+			if !selectedMailbox {
+				messages = nil
+				for _, account := range accounts {
+					for _, folder := range mailboxFolders(account.config, localUser, folderSuffix) {
+						folderMessages, err := account.upstream.openFolder(folder, mailboxView(account.config, localUser), s.shared.watch.snapshot(account.config, folder))
+						var folderErr *folderError
+						if errors.As(err, &folderErr) {
+							fmt.Fprintf(localConn, "-ERR Cannot select %s\r\n", folder)
+							log.Printf("[POP3] PROXY -> CLIENT (%s): -ERR Cannot select %s on %s: %s", clientAddr, folder, account.server, folderErr.result)
+							return
 						}
-
-						if strings.HasPrefix(response, fmt.Sprintf("A%d OK", imapTag)) {
-							selectedMailbox = true
-							break
-						} else if strings.HasPrefix(response, fmt.Sprintf("A%d NO", imapTag)) || strings.HasPrefix(response, fmt.Sprintf("A%d BAD", imapTag)) {
-							fmt.Fprintf(localConn, "-ERR Cannot select INBOX\r\n")
-							log.Printf("[POP3] PROXY -> CLIENT (%s): -ERR Cannot select INBOX", clientAddr)
+						if err != nil {
+							s.reportUpstreamFailure(localConn, clientAddr, err)
 							return
 						}
+						for i, msg := range folderMessages {
+							m := maildropMessage{IMAPMessage: msg, account: account}
+							if i == 0 {
+								s.shared.cache.validate(messageCacheKey(m), m.UIDValidity)
+							}
+							messages = append(messages, m)
+						}
 					}
 				}
-
-				pop3State = "TRANSACTION"
-				fmt.Fprintf(localConn, "+OK Mailbox locked and ready\r\n")
-				log.Printf("[POP3] PROXY -> CLIENT (%s): +OK Mailbox locked and ready", clientAddr)
+				messageCount = len(messages)
+				selectedMailbox = true
 			}
 
+			pop3State = "TRANSACTION"
+			fmt.Fprintf(localConn, "+OK Mailbox locked and ready\r\n")
+			log.Printf("[POP3] PROXY -> CLIENT (%s): +OK Mailbox locked and ready", clientAddr)
+
 		case "STAT":
 			if pop3State != "TRANSACTION" {
 				fmt.Fprintf(localConn, "-ERR Command not valid in this state\r\n")
 				continue
 			}
 
-			// Get mailbox status from IMAP
+			// Get mailbox status from IMAP; messages marked for deletion are not counted
 			totalSize := 0
-			for _, msg := range messages {
-				totalSize += msg.Size
+			for i := range messages {
+				if !deleted[i+1] {
+					totalSize += s.messageSize(messages[i])
+				}
 			}
+			count := messageCount - len(deleted)
 
-			fmt.Fprintf(localConn, "+OK %d %d\r\n", messageCount, totalSize)
-			log.Printf("[POP3] PROXY -> CLIENT (%s): +OK %d %d", clientAddr, messageCount, totalSize)
+			fmt.Fprintf(localConn, "+OK %d %d\r\n", count, totalSize)
+			log.Printf("[POP3] PROXY -> CLIENT (%s): +OK %d %d", clientAddr, count, totalSize)
 
 		case "LIST":
 			if pop3State != "TRANSACTION" {
@@ -364,9 +781,12 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 
 			if len(parts) == 1 {
 				// LIST all messages
-				fmt.Fprintf(localConn, "+OK %d messages\r\n", messageCount)
+				fmt.Fprintf(localConn, "+OK %d messages\r\n", messageCount-len(deleted))
 				for i := 1; i <= messageCount; i++ {
-					size := 1024 // Default size, would need IMAP FETCH to get real size
+					if deleted[i] {
+						continue
+					}
+					size := s.messageSize(messages[i-1])
 					fmt.Fprintf(localConn, "%d %d\r\n", i, size)
 				}
 				fmt.Fprintf(localConn, ".\r\n")
@@ -374,7 +794,11 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 			} else if len(parts) == 2 {
 				// LIST specific message
 				if msgNum, err := strconv.Atoi(parts[1]); err == nil && msgNum > 0 && msgNum <= messageCount {
-					size := 1024 // Default size
+					if deleted[msgNum] {
+						fmt.Fprintf(localConn, "-ERR Message %d already deleted\r\n", msgNum)
+						continue
+					}
+					size := s.messageSize(messages[msgNum-1])
 					fmt.Fprintf(localConn, "+OK %d %d\r\n", msgNum, size)
 					log.Printf("[POP3] PROXY -> CLIENT (%s): +OK %d %d", clientAddr, msgNum, size)
 				} else {
@@ -392,9 +816,10 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 				// UIDL all messages
 				fmt.Fprintf(localConn, "+OK unique-id listing follows\r\n")
 				for i := 1; i <= messageCount; i++ {
-					// Generate a simple UID based on message number
-					// In a real implementation, you'd get this from IMAP UID FETCH
-					uid := fmt.Sprintf("%s.%d", upstreamConfig.Username, i)
+					if deleted[i] {
+						continue
+					}
+					uid := messageUIDL(messages[i-1])
 					fmt.Fprintf(localConn, "%d %s\r\n", i, uid)
 				}
 				fmt.Fprintf(localConn, ".\r\n")
@@ -402,7 +827,11 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 			} else if len(parts) == 2 {
 				// UIDL specific message
 				if msgNum, err := strconv.Atoi(parts[1]); err == nil && msgNum > 0 && msgNum <= messageCount {
-					uid := fmt.Sprintf("%s.%d", upstreamConfig.Username, msgNum)
+					if deleted[msgNum] {
+						fmt.Fprintf(localConn, "-ERR Message %d already deleted\r\n", msgNum)
+						continue
+					}
+					uid := messageUIDL(messages[msgNum-1])
 					fmt.Fprintf(localConn, "+OK %d %s\r\n", msgNum, uid)
 					log.Printf("[POP3] PROXY -> CLIENT (%s): +OK %d %s", clientAddr, msgNum, uid)
 				} else {
@@ -426,39 +855,72 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 				fmt.Fprintf(localConn, "-ERR No such message\r\n")
 				continue
 			}
+			if deleted[msgNum] {
+				fmt.Fprintf(localConn, "-ERR Message %d already deleted\r\n", msgNum)
+				continue
+			}
 
-			// Fetch message from IMAP
-			imapTag++
-			fetchCmd := fmt.Sprintf("A%d FETCH %d (RFC822)\r\n", imapTag, msgNum)
-			fmt.Fprintf(upstreamConn, fetchCmd)
-			log.Printf("[POP3] PROXY -> IMAP-SERVER (%s): A%d FETCH %d (RFC822)", clientAddr, imapTag, msgNum)
-
-			fmt.Fprintf(localConn, "+OK Message follows\r\n")
-
-			// Read and forward IMAP FETCH response
-			inMessage := false
-			for scanner.Scan() {
-				response := scanner.Text()
-				log.Printf("[POP3] IMAP-SERVER -> PROXY (%s): %s", clientAddr, response)
-
-				if strings.Contains(response, "RFC822") {
-					inMessage = true
-					continue
+			msg := messages[msgNum-1]
+			upstream := msg.account.upstream
+			record := journalRecord{
+				Kind:      "retr",
+				ClientIP:  clientIP(localConn),
+				LocalUser: loginName,
+				Upstream:  fmt.Sprintf("%s (%s)", msg.account.config.Username, msg.account.server),
+			}
+			if s.shared.cache.accepts(messageCacheKey(msg), int64(msg.Size)) {
+				// Fetch message from the cache or IMAP
+				data, err := s.loadMessage(msg)
+				if err != nil {
+					s.reportUpstreamFailure(localConn, clientAddr, err)
+					return
 				}
-
-				if inMessage {
-					if strings.HasPrefix(response, fmt.Sprintf("A%d OK", imapTag)) {
-						break
-					} else if strings.HasPrefix(response, ")") {
-						continue
-					} else {
-						fmt.Fprintf(localConn, "%s\r\n", response)
+				fmt.Fprintf(localConn, "+OK %d octets\r\n", len(data))
+				if err := writeMessage(localConn, data, -1); err != nil {
+					log.Printf("[POP3] Sending message %d to client %s failed: %v", msgNum, clientAddr, err)
+					return
+				}
+				s.shared.journal.record(record, data)
+			} else {
+				// Messages the cache would not keep are streamed from IMAP as they arrive
+				if err := upstream.selectFolder(msg.Folder); err != nil {
+					s.reportUpstreamFailure(localConn, clientAddr, err)
+					return
+				}
+				fmt.Fprintf(localConn, "+OK %d octets\r\n", msg.Size)
+				mw := newMessageWriter(localConn, -1)
+				var w io.Writer = mw
+				entry := s.shared.journal.start(record)
+				if entry != nil {
+					w = io.MultiWriter(mw, entry)
+				}
+				err := upstream.streamMessage(msg.UID, w)
+				if err == nil {
+					err = mw.Close()
+				}
+				if err != nil {
+					if entry != nil {
+						entry.abort()
 					}
+					// The response has started, so the client can only be disconnected
+					LogError("[POP3] Streaming message %d to client %s failed: %v", msgNum, clientAddr, err)
+					return
+				}
+				if entry != nil {
+					entry.commit()
 				}
 			}
-
-			fmt.Fprintf(localConn, ".\r\n")
-			LogInfo("📩 EMAIL DOWNLOADED: Message %d delivered to client for %s", msgNum, upstreamConfig.Username)
+			if msg.account.config.MarkSeen == "retr" {
+				// A message served from the cache may be in a folder that is not selected
+				err := upstream.selectFolder(msg.Folder)
+				if err == nil {
+					err = upstream.markSeen(msg.UID)
+				}
+				if err != nil {
+					LogError("[POP3] Marking message %d as seen failed for client %s: %v", msgNum, clientAddr, err)
+				}
+			}
+			LogInfo("📩 EMAIL DOWNLOADED: Message %d delivered to client for %s", msgNum, msg.account.config.Username)
 
 		case "TOP":
 			if pop3State != "TRANSACTION" {
@@ -476,6 +938,10 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 				fmt.Fprintf(localConn, "-ERR No such message\r\n")
 				continue
 			}
+			if deleted[msgNum] {
+				fmt.Fprintf(localConn, "-ERR Message %d already deleted\r\n", msgNum)
+				continue
+			}
 
 			lines, err := strconv.Atoi(parts[2])
 			if err != nil || lines < 0 {
@@ -483,58 +949,19 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 				continue
 			}
 
-			// Fetch message headers and body from IMAP
-			imapTag++
-			fetchCmd := fmt.Sprintf("A%d FETCH %d (RFC822)\r\n", imapTag, msgNum)
-			fmt.Fprintf(upstreamConn, fetchCmd)
-			log.Printf("[POP3] PROXY -> IMAP-SERVER (%s): A%d FETCH %d (RFC822) for TOP %d lines", clientAddr, imapTag, msgNum, lines)
+			// Use the cached message, otherwise fetch only the header and the first lines
+			data, err := s.loadTop(messages[msgNum-1], lines)
+			if err != nil {
+				s.reportUpstreamFailure(localConn, clientAddr, err)
+				return
+			}
 
+			// Always send headers, then only the requested number of body lines
 			fmt.Fprintf(localConn, "+OK Top of message follows\r\n")
-
-			// Read and forward IMAP FETCH response with line limiting
-			inMessage := false
-			headersDone := false
-			bodyLines := 0
-			for scanner.Scan() {
-				response := scanner.Text()
-				log.Printf("[POP3] IMAP-SERVER -> PROXY (%s): %s", clientAddr, response)
-
-				if strings.Contains(response, "RFC822") {
-					inMessage = true
-					continue
-				}
-
-				if inMessage {
-					if strings.HasPrefix(response, fmt.Sprintf("A%d OK", imapTag)) {
-						break
-					} else if strings.HasPrefix(response, ")") {
-						continue
-					} else {
-						// Check if we've reached the end of headers
-						if !headersDone && response == "" {
-							headersDone = true
-							fmt.Fprintf(localConn, "\r\n")
-							continue
-						}
-
-						// Always send headers
-						if !headersDone {
-							fmt.Fprintf(localConn, "%s\r\n", response)
-						} else {
-							// Only send specified number of body lines
-							if bodyLines < lines {
-								fmt.Fprintf(localConn, "%s\r\n", response)
-								bodyLines++
-							} else {
-								// Skip remaining body lines
-								continue
-							}
-						}
-					}
-				}
+			if err := writeMessage(localConn, data, lines); err != nil {
+				log.Printf("[POP3] Sending message %d to client %s failed: %v", msgNum, clientAddr, err)
+				return
 			}
-
-			fmt.Fprintf(localConn, ".\r\n")
 			log.Printf("[POP3] PROXY -> CLIENT (%s): TOP of message %d delivered (%d body lines)", clientAddr, msgNum, lines)
 
 		case "DELE":
@@ -553,25 +980,47 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 				fmt.Fprintf(localConn, "-ERR No such message\r\n")
 				continue
 			}
-
-			// Mark message for deletion in IMAP
-			imapTag++
-			storeCmd := fmt.Sprintf("A%d STORE %d +FLAGS (\\Deleted)\r\n", imapTag, msgNum)
-			fmt.Fprintf(upstreamConn, storeCmd)
-			log.Printf("[POP3] PROXY -> IMAP-SERVER (%s): A%d STORE %d +FLAGS (\\Deleted)", clientAddr, imapTag, msgNum)
-
-			// Read IMAP response
-			for scanner.Scan() {
-				response := scanner.Text()
-				log.Printf("[POP3] IMAP-SERVER -> PROXY (%s): %s", clientAddr, response)
-				if strings.HasPrefix(response, fmt.Sprintf("A%d OK", imapTag)) {
-					break
-				}
+			if deleted[msgNum] {
+				fmt.Fprintf(localConn, "-ERR Message %d already deleted\r\n", msgNum)
+				continue
 			}
 
+			// Only marked here; the upstream mailbox changes at QUIT, so a
+			// dropped connection never deletes anything (RFC 1939)
+			deleted[msgNum] = true
+
 			fmt.Fprintf(localConn, "+OK Message %d deleted\r\n", msgNum)
 			log.Printf("[POP3] PROXY -> CLIENT (%s): +OK Message %d deleted", clientAddr, msgNum)
 
+		case "CAPA":
+			// RFC 2449 capability list
+			fmt.Fprintf(localConn, "+OK Capability list follows\r\n")
+			fmt.Fprintf(localConn, "USER\r\nTOP\r\nUIDL\r\nRESP-CODES\r\nAUTH-RESP-CODE\r\n")
+			if s.tlsConfig != nil && s.listenerConfig.StartTLS && !isTLSConn(localConn) && pop3State == "AUTHORIZATION" {
+				fmt.Fprintf(localConn, "STLS\r\n")
+			}
+			fmt.Fprintf(localConn, "IMPLEMENTATION Proxy-Mail\r\n.\r\n")
+			log.Printf("[POP3] PROXY -> CLIENT (%s): capability list", clientAddr)
+
+		case "STLS":
+			// RFC 2595: upgrade the connection before authentication
+			if pop3State != "AUTHORIZATION" || serverConfig != nil || isTLSConn(localConn) ||
+				s.tlsConfig == nil || !s.listenerConfig.StartTLS {
+				fmt.Fprintf(localConn, "-ERR Command not permitted\r\n")
+				continue
+			}
+			fmt.Fprintf(localConn, "+OK Begin TLS negotiation\r\n")
+			tlsConn := tls.Server(localConn, s.tlsConfig)
+			tlsConn.SetDeadline(time.Now().Add(localTLSHandshakeTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				log.Printf("[POP3] STLS handshake with client %s failed: %v", clientAddr, err)
+				return
+			}
+			tlsConn.SetDeadline(time.Time{})
+			localConn = tlsConn
+			clientReader = bufio.NewReader(localConn)
+			log.Printf("[POP3] Client %s upgraded to TLS", clientAddr)
+
 		case "NOOP":
 			fmt.Fprintf(localConn, "+OK\r\n")
 			log.Printf("[POP3] PROXY -> CLIENT (%s): +OK", clientAddr)
@@ -582,48 +1031,24 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 				continue
 			}
 
-			// Remove all deletion marks in IMAP
-			imapTag++
-			storeCmd := fmt.Sprintf("A%d STORE 1:%d -FLAGS (\\Deleted)\r\n", imapTag, messageCount)
-			fmt.Fprintf(upstreamConn, storeCmd)
-			log.Printf("[POP3] PROXY -> IMAP-SERVER (%s): A%d STORE 1:%d -FLAGS (\\Deleted)", clientAddr, imapTag, messageCount)
+			// Remove all deletion marks
+			deleted = make(map[int]bool)
 
-			// Read IMAP response
-			for scanner.Scan() {
-				response := scanner.Text()
-				log.Printf("[POP3] IMAP-SERVER -> PROXY (%s): %s", clientAddr, response)
-				if strings.HasPrefix(response, fmt.Sprintf("A%d OK", imapTag)) {
-					break
-				}
-			}
-
-			fmt.Fprintf(localConn, "+OK\r\n")
+			fmt.Fprintf(localConn, "+OK maildrop has %d messages\r\n", messageCount)
 			log.Printf("[POP3] PROXY -> CLIENT (%s): +OK Reset completed", clientAddr)
 
 		case "QUIT":
-			if pop3State == "TRANSACTION" {
-				// Expunge deleted messages in IMAP
-				imapTag++
-				expungeCmd := fmt.Sprintf("A%d EXPUNGE\r\n", imapTag)
-				fmt.Fprintf(upstreamConn, expungeCmd)
-				log.Printf("[POP3] PROXY -> IMAP-SERVER (%s): A%d EXPUNGE", clientAddr, imapTag)
-
-				// Read IMAP response
-				for scanner.Scan() {
-					response := scanner.Text()
-					log.Printf("[POP3] IMAP-SERVER -> PROXY (%s): %s", clientAddr, response)
-					if strings.HasPrefix(response, fmt.Sprintf("A%d OK", imapTag)) {
-						break
-					}
+			if pop3State == "TRANSACTION" && len(deleted) > 0 {
+				// UPDATE state: delete the marked messages in IMAP
+				if err := s.applyDeletions(messages, deleted); err != nil {
+					LogError("[POP3] Deleting messages failed for client %s: %v", clientAddr, err)
+					fmt.Fprintf(localConn, "-ERR [SYS/TEMP] Some deleted messages not removed\r\n")
+					return
 				}
+				LogInfo("🗑️ Deleted %d messages for %s", len(deleted), clientUsername)
 			}
 
-			// Logout from IMAP
-			imapTag++
-			logoutCmd := fmt.Sprintf("A%d LOGOUT\r\n", imapTag)
-			fmt.Fprintf(upstreamConn, logoutCmd)
-			log.Printf("[POP3] PROXY -> IMAP-SERVER (%s): A%d LOGOUT", clientAddr, imapTag)
-
+			// The upstream connection goes back to the pool instead of logging out
 			fmt.Fprintf(localConn, "+OK Goodbye\r\n")
 			log.Printf("[POP3] PROXY -> CLIENT (%s): +OK Goodbye", clientAddr)
 			return
@@ -633,13 +1058,4 @@ func (s *POP3Server) handleIMAPBackend(localConn net.Conn, clientAddr string) {
 			log.Printf("[POP3] PROXY -> CLIENT (%s): -ERR Unknown command: %s", clientAddr, command)
 		}
 	}
-
-	// Safe cleanup logging at the end of the function
-	if upstreamConfig != nil {
-		log.Printf("[POP3] Client %s disconnected from IMAP mailbox %s", 
-			clientAddr, upstreamConfig.Username)
-	} else {
-		log.Printf("[POP3] Client %s disconnected", clientAddr)
-	}
 }
-
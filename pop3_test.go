@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads a configuration written as YAML
+func loadTestConfig(t *testing.T, yaml string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return cfg
+}
+
+// startTestPOP3 runs a POP3 listener on a free loopback port
+func startTestPOP3(t *testing.T, cfg *Config, listener ListenerConfig) (*POP3Server, string) {
+	t.Helper()
+	shared, err := newSharedState(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Name, listener.Host = "test", "127.0.0.1"
+	server := NewPOP3Server(cfg, listener, shared)
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	t.Cleanup(func() { server.Stop() })
+	return server, server.listener.Addr().String()
+}
+
+// pop3Login runs USER and PASS in a new session and returns the reply to PASS
+func pop3Login(t *testing.T, addr, user, pass string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func() string {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+	reply() // greeting
+	fmt.Fprintf(conn, "USER %s\r\n", user)
+	if line := reply(); !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("USER %s: %s", user, line)
+	}
+	fmt.Fprintf(conn, "PASS %s\r\n", pass)
+	return reply()
+}
+
+const folderLoginConfig = `
+servers:
+  - name: a
+    imap: {host: 127.0.0.1, port: 1, username: alice@example.com, password: upstream}
+auth_guard:
+  max_failures: 3
+  delay: 1ms
+  max_delay: 1ms
+local:
+  pop3: {host: 127.0.0.1, port: 0}
+  users:
+    - username: alice
+      password: secret
+      server: a
+`
+
+func TestFolderLoginIsBannedLikeBareLogin(t *testing.T) {
+	cfg := loadTestConfig(t, folderLoginConfig)
+	server, addr := startTestPOP3(t, cfg, ListenerConfig{})
+
+	// Rotating suffixes must count against the same user
+	for _, user := range []string{"alice+a", "alice+b", "alice+c"} {
+		if reply := pop3Login(t, addr, user, "wrong"); !strings.Contains(reply, "Authentication failed") {
+			t.Fatalf("PASS for %s: %s", user, reply)
+		}
+	}
+	// Checked from another address, so only the username ban counts
+	if !server.shared.guard.banned("192.0.2.1", "alice") {
+		t.Error("alice is not banned after failures with folder suffixes")
+	}
+}
+
+func TestFolderLoginIsDeniedLikeBareLogin(t *testing.T) {
+	cfg := loadTestConfig(t, folderLoginConfig+"      deny: [127.0.0.1]\n")
+	_, addr := startTestPOP3(t, cfg, ListenerConfig{})
+
+	bare := pop3Login(t, addr, "alice", "secret")
+	if !strings.Contains(bare, "Access denied") {
+		t.Fatalf("bare login from a denied address: %s", bare)
+	}
+	for _, user := range []string{"alice+Junk", "alice+INBOX"} {
+		if reply := pop3Login(t, addr, user, "secret"); reply != bare {
+			t.Errorf("PASS for %s: got %q, want %q", user, reply, bare)
+		}
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		bodyLines int
+		want      string
+	}{
+		{name: "CRLF message", data: "Subject: a\r\n\r\nbody\r\n", bodyLines: -1, want: "Subject: a\r\n\r\nbody\r\n.\r\n"},
+		{name: "leading dot", data: "Subject: a\r\n\r\n.hidden\r\n..two\r\n", bodyLines: -1, want: "Subject: a\r\n\r\n..hidden\r\n...two\r\n.\r\n"},
+		{name: "dot line in body", data: "Subject: a\r\n\r\nbefore\r\n.\r\nafter\r\n", bodyLines: -1, want: "Subject: a\r\n\r\nbefore\r\n..\r\nafter\r\n.\r\n"},
+		{name: "bare LF", data: "Subject: a\n\n.line\nend\n", bodyLines: -1, want: "Subject: a\r\n\r\n..line\r\nend\r\n.\r\n"},
+		{name: "bare CR stays", data: "Subject: a\r\n\r\nx\ry\r\n", bodyLines: -1, want: "Subject: a\r\n\r\nx\ry\r\n.\r\n"},
+		{name: "no trailing CRLF", data: "Subject: a\r\n\r\nlast", bodyLines: -1, want: "Subject: a\r\n\r\nlast\r\n.\r\n"},
+		{name: "no trailing LF after CR", data: "Subject: a\r\n\r\nlast\r", bodyLines: -1, want: "Subject: a\r\n\r\nlast\r\r\n.\r\n"},
+		{name: "empty message", data: "", bodyLines: -1, want: ".\r\n"},
+		{name: "TOP with body lines", data: "Subject: a\r\n\r\n.one\r\ntwo\r\nthree\r\n", bodyLines: 2, want: "Subject: a\r\n\r\n..one\r\ntwo\r\n.\r\n"},
+		{name: "TOP without body lines", data: "Subject: a\n\nbody\n", bodyLines: 0, want: "Subject: a\r\n\r\n.\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			if err := writeMessage(&out, []byte(tt.data), tt.bodyLines); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+
+			// Lines and line endings may be split across writes
+			out.Reset()
+			mw := newMessageWriter(&out, tt.bodyLines)
+			for i := range tt.data {
+				mw.Write([]byte{tt.data[i]})
+			}
+			if err := mw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("written byte by byte: got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDeniedClientUsesNoConnectionSlot(t *testing.T) {
+	cfg := loadTestConfig(t, folderLoginConfig+"limits:\n  connection_rate_per_ip: 1\n")
+	server, addr := startTestPOP3(t, cfg, ListenerConfig{Deny: []string{"127.0.0.1"}})
+
+	// With a rate of 1 per minute, a second counted connection would be refused
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != "-ERR Access denied\r\n" {
+			t.Fatalf("connection %d: got %q, want the access denied reply", i+1, reply)
+		}
+	}
+	server.shared.conns.mu.Lock()
+	defer server.shared.conns.mu.Unlock()
+	if n := len(server.shared.conns.recent["127.0.0.1"]); n != 0 {
+		t.Errorf("denied connections counted against the rate limit: %d", n)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a load balancer may take to send the PROXY header
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyHeader = errors.New("missing PROXY protocol header")
+
+// proxyConn is a client connection received through a load balancer. It reports
+// the client address announced in the PROXY header instead of the balancer's.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from conn and
+// returns a connection that reports the real client address
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	// Both header versions are longer than the v2 signature
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.Equal(signature, proxyV2Signature):
+		remote, err = parseProxyV2(reader)
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		remote, err = parseProxyV1(reader)
+	default:
+		return nil, errNoProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		// LOCAL / UNKNOWN: health checks from the balancer itself
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// parseProxyV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst srcport dstport\r\n"
+func parseProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY v1 header: %w", err)
+	}
+	if len(line) > 107 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", strings.TrimSpace(line))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed PROXY v1 address: %q", strings.TrimSpace(line))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// parseProxyV2 parses the binary PROXY protocol v2 header
+func parseProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+	versionCommand := header[12]
+	family := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 addresses: %w", err)
+	}
+
+	switch versionCommand & 0x0F {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", versionCommand&0x0F)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// UNSPEC or non-TCP families carry no usable client address
+		return nil, nil
+	}
+}
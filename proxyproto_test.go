@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// balancerAddr is where test connections come from
+var balancerAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 10), Port: 40000}
+
+// bytesConn is a connection that reads from a buffer
+type bytesConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bytesConn) Read(b []byte) (int, error)        { return c.reader.Read(b) }
+func (c *bytesConn) RemoteAddr() net.Addr              { return balancerAddr }
+func (c *bytesConn) SetReadDeadline(t time.Time) error { return nil }
+
+// proxyV2 builds a v2 header with the given version/command, family and address block
+func proxyV2(versionCommand, family byte, addresses []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, versionCommand, family, byte(len(addresses)>>8), byte(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4Block := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0x03, 0xe1}
+	ipv6Block := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x03, 0xe1)
+
+	tests := []struct {
+		name    string
+		header  string
+		want    string // client address, or the error text when wantErr
+		wantErr bool
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 192.0.2.1 10.0.0.1 12345 995\r\n", want: "192.0.2.1:12345"},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 995\r\n", want: "[2001:db8::1]:12345"},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n", want: balancerAddr.String()},
+		{name: "v1 UNKNOWN with addresses", header: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", want: balancerAddr.String()},
+		{name: "v1 over 107 bytes", header: "PROXY TCP6 " + strings.Repeat("0", 90) + " ::1 1 2\r\n", want: "malformed PROXY v1 header", wantErr: true},
+		{name: "v1 without CRLF", header: "PROXY TCP4 192.0.2.1 10.0.0.1 12345 995\n", want: "malformed PROXY v1 header", wantErr: true},
+		{name: "v1 bad port", header: "PROXY TCP4 192.0.2.1 10.0.0.1 65536 995\r\n", want: "malformed PROXY v1 address", wantErr: true},
+		{name: "v1 port not a number", header: "PROXY TCP4 192.0.2.1 10.0.0.1 http 995\r\n", want: "malformed PROXY v1 address", wantErr: true},
+		{name: "v1 bad address", header: "PROXY TCP4 192.0.2.300 10.0.0.1 12345 995\r\n", want: "malformed PROXY v1 address", wantErr: true},
+		{name: "v1 unknown protocol", header: "PROXY UDP4 192.0.2.1 10.0.0.1 12345 995\r\n", want: "malformed PROXY v1 header", wantErr: true},
+		{name: "v2 TCP4", header: string(proxyV2(0x21, 0x11, ipv4Block)), want: "192.0.2.1:12345"},
+		{name: "v2 TCP6", header: string(proxyV2(0x21, 0x21, ipv6Block)), want: "[2001:db8::1]:12345"},
+		{name: "v2 TCP4 with TLVs", header: string(proxyV2(0x21, 0x11, append(ipv4Block, 0x04, 0x00, 0x01, 0x00))), want: "192.0.2.1:12345"},
+		{name: "v2 LOCAL", header: string(proxyV2(0x20, 0x00, nil)), want: balancerAddr.String()},
+		{name: "v2 UNSPEC", header: string(proxyV2(0x21, 0x00, nil)), want: balancerAddr.String()},
+		{name: "v2 short IPv4 block", header: string(proxyV2(0x21, 0x11, ipv4Block[:8])), want: "short PROXY v2 IPv4 address block", wantErr: true},
+		{name: "v2 short IPv6 block", header: string(proxyV2(0x21, 0x21, ipv6Block[:32])), want: "short PROXY v2 IPv6 address block", wantErr: true},
+		{name: "v2 truncated address block", header: string(proxyV2(0x21, 0x11, ipv4Block)[:20]), want: "reading PROXY v2 addresses", wantErr: true},
+		{name: "v2 unsupported version", header: string(proxyV2(0x11, 0x11, ipv4Block)), want: "unsupported PROXY protocol version 1", wantErr: true},
+		{name: "v2 unsupported command", header: string(proxyV2(0x22, 0x11, ipv4Block)), want: "unsupported PROXY v2 command 2", wantErr: true},
+		{name: "no header", header: "EHLO client.example.com\r\n", want: errNoProxyHeader.Error(), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The client's first command follows the header and must survive it
+			data := tt.header + "CAPA\r\n"
+			conn, err := readProxyHeader(&bytesConn{reader: strings.NewReader(data)})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got client %s, want error %q", conn.RemoteAddr(), tt.want)
+				}
+				if !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("got error %q, want %q", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := conn.RemoteAddr().String(); got != tt.want {
+				t.Errorf("got client %s, want %s", got, tt.want)
+			}
+			rest, _ := io.ReadAll(conn)
+			if !bytes.Equal(rest, []byte("CAPA\r\n")) {
+				t.Errorf("got %q after the header, want the client's command", rest)
+			}
+		})
+	}
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outboundQueue is the store-and-forward spool of the SMTP listeners. A
+// message is accepted once it and its envelope are synced to disk, and is
+// relayed upstream in the background, with exponential backoff between
+// attempts. Recipients the upstream server rejects, and those still
+// undelivered after the expiry, are reported to the sender with a delivery
+// status notification (see dsn.go). A nil queue means messages are relayed
+// synchronously.
+//
+// Each message is two files in the spool directory: <id>.eml holds the
+// message and <id>.json the envelope and delivery state. The .json file is
+// written last, so a message without one was never acknowledged.
+type outboundQueue struct {
+	cfg    QueueConfig
+	config *Config
+	logins *loginLimiter
+	pool   *imapPool // for bounce_to: inbox
+	sent   *sentCopier
+
+	mu       sync.Mutex
+	messages map[string]*queuedMessage
+
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// queuedMessage is the envelope and delivery state of a spooled message
+type queuedMessage struct {
+	ID        string    `json:"id"`
+	Server    string    `json:"server"` // server whose smtp block relays the message
+	From      string    `json:"from"`
+	To        []string  `json:"to"` // recipients not delivered yet
+	Client    string    `json:"client,omitempty"`
+	Received  time.Time `json:"received"`
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"next_try"`
+	LastError string    `json:"last_error,omitempty"`
+	SentSaved bool      `json:"sent_saved,omitempty"` // copied to the Sent folder
+	Bounce    bool      `json:"bounce,omitempty"`     // a bounce, which is never bounced itself
+	Delayed   bool      `json:"delayed,omitempty"`    // a delay notification was sent
+	dsnOptions
+}
+
+// deliveryStatus is the upstream reply for one recipient of a relay attempt
+type deliveryStatus struct {
+	Rcpt  string
+	Code  int // SMTP reply code; 0 when there was no reply
+	Reply string
+}
+
+func (st deliveryStatus) delivered() bool { return st.Code >= 200 && st.Code < 300 }
+func (st deliveryStatus) permanent() bool { return st.Code >= 500 }
+
+func newOutboundQueue(config *Config, logins *loginLimiter, pool *imapPool, sent *sentCopier) (*outboundQueue, error) {
+	if config.Queue.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(config.Queue.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+	q := &outboundQueue{
+		cfg:      config.Queue,
+		config:   config,
+		logins:   logins,
+		pool:     pool,
+		sent:     sent,
+		messages: make(map[string]*queuedMessage),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+	if len(q.messages) > 0 {
+		log.Printf("[QUEUE] %d queued messages waiting for delivery", len(q.messages))
+	}
+	q.wg.Add(1)
+	go q.run()
+	return q, nil
+}
+
+// close stops the delivery worker after the attempt in progress. Queued
+// messages stay on disk for the next start.
+func (q *outboundQueue) close() {
+	if q == nil {
+		return
+	}
+	close(q.stop)
+	q.wg.Wait()
+}
+
+// load reads the spool left by an earlier run and removes files of messages
+// that were never acknowledged
+func (q *outboundQueue) load() error {
+	entries, err := os.ReadDir(q.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(q.cfg.Dir, name)
+		switch filepath.Ext(name) {
+		case ".tmp":
+			os.Remove(path)
+		case ".eml":
+			if _, err := os.Stat(strings.TrimSuffix(path, ".eml") + ".json"); errors.Is(err, os.ErrNotExist) {
+				os.Remove(path)
+			}
+		case ".json":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			msg := &queuedMessage{}
+			if err := json.Unmarshal(data, msg); err != nil || msg.ID == "" {
+				LogError("Queue: ignoring unreadable %s: %v", name, err)
+				continue
+			}
+			if _, err := os.Stat(q.messagePath(msg)); err != nil {
+				LogError("Queue: dropping %s: %v", msg.ID, err)
+				os.Remove(path)
+				continue
+			}
+			q.messages[msg.ID] = msg
+		}
+	}
+	return nil
+}
+
+// enqueue spools a message for server and returns its queue ID once it is on
+// disk. message is the message itself, not dot-stuffed.
+func (q *outboundQueue) enqueue(server *ServerConfig, from string, to []string, dsn dsnOptions, client string, message []byte) (string, error) {
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+	msg := &queuedMessage{ID: id, Server: server.Name, From: from, To: to, Client: client, Received: time.Now(), dsnOptions: dsn}
+	if err := q.add(msg, message); err != nil {
+		return "", err
+	}
+	LogInfo("📮 QUEUE: Message %s from <%s> to %d recipients queued for %s", id, from, len(to), server.SMTP.Username)
+	for _, rcpt := range to {
+		log.Printf("[DSN] %s <%s>: queued", id, rcpt)
+	}
+	return id, nil
+}
+
+// add writes a new message to the spool and wakes the worker
+func (q *outboundQueue) add(msg *queuedMessage, message []byte) error {
+	if err := writeSynced(q.messagePath(msg), message); err != nil {
+		return err
+	}
+	if err := q.save(msg); err != nil {
+		os.Remove(q.messagePath(msg))
+		return err
+	}
+	q.mu.Lock()
+	q.messages[msg.ID] = msg
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// save replaces the envelope file of a message
+func (q *outboundQueue) save(msg *queuedMessage) error {
+	data, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeSynced(filepath.Join(q.cfg.Dir, msg.ID+".json"), data)
+}
+
+// remove deletes a message that needs no further delivery
+func (q *outboundQueue) remove(msg *queuedMessage) {
+	q.mu.Lock()
+	delete(q.messages, msg.ID)
+	q.mu.Unlock()
+	if err := os.Remove(filepath.Join(q.cfg.Dir, msg.ID+".json")); err != nil {
+		LogError("Queue: %v", err)
+	}
+	os.Remove(q.messagePath(msg))
+}
+
+func (q *outboundQueue) messagePath(msg *queuedMessage) string {
+	return filepath.Join(q.cfg.Dir, msg.ID+".eml")
+}
+
+// run delivers messages as they become due
+func (q *outboundQueue) run() {
+	defer q.wg.Done()
+	for {
+		next := q.deliverDue()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		case <-q.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue attempts every message whose retry time has come, oldest first,
+// and returns when the next one is due
+func (q *outboundQueue) deliverDue() time.Time {
+	now := time.Now()
+	var due []*queuedMessage
+	q.mu.Lock()
+	for _, msg := range q.messages {
+		if !msg.NextTry.After(now) {
+			due = append(due, msg)
+		}
+	}
+	q.mu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].Received.Before(due[j].Received) })
+
+	for _, msg := range due {
+		select {
+		case <-q.stop:
+			return now
+		default:
+		}
+		q.attempt(msg)
+	}
+
+	next := time.Now().Add(q.cfg.RetryMax)
+	q.mu.Lock()
+	for _, msg := range q.messages {
+		if msg.NextTry.Before(next) {
+			next = msg.NextTry
+		}
+	}
+	q.mu.Unlock()
+	return next
+}
+
+// attempt relays a message to its remaining recipients and reschedules,
+// bounces or removes it depending on the outcome
+func (q *outboundQueue) attempt(msg *queuedMessage) {
+	server := q.config.GetServerByName(msg.Server)
+	if server == nil || server.SMTP == nil {
+		reason := fmt.Sprintf("server %q is no longer configured for smtp", msg.Server)
+		var remaining []deliveryStatus
+		for _, rcpt := range msg.To {
+			remaining = append(remaining, deliveryStatus{Rcpt: rcpt, Reply: reason})
+		}
+		q.retryLater(msg, nil, remaining, nil)
+		return
+	}
+	if !q.logins.acquire(server.SMTP) {
+		// Not an attempt: the mailbox is busy, so try again soon
+		msg.NextTry = time.Now().Add(q.cfg.RetryMin)
+		if err := q.save(msg); err != nil {
+			LogError("Queue: %v", err)
+		}
+		return
+	}
+	message, err := os.ReadFile(q.messagePath(msg))
+	if err != nil {
+		q.logins.release(server.SMTP)
+		LogError("Queue: dropping %s: %v", msg.ID, err)
+		q.remove(msg)
+		return
+	}
+	statuses, upstreamDSN := relayMessage(server.SMTP, q.config.Timeouts, msg.From, msg.To, &msg.dsnOptions, message)
+	q.logins.release(server.SMTP)
+
+	// Once the upstream server has the DSN extension it reports success
+	// and later failures itself; otherwise the proxy reports "relayed"
+	var remaining []deliveryStatus
+	var relayed, failed []deliveryStatus
+	delivered := 0
+	for _, st := range statuses {
+		switch {
+		case st.delivered():
+			delivered++
+			action := "delivered"
+			if !upstreamDSN {
+				action = dsnRelayed
+				if msg.wants(st.Rcpt, "SUCCESS") {
+					relayed = append(relayed, st)
+				}
+			}
+			logDeliveryStatus(msg.ID, st.Rcpt, action, st)
+		case st.permanent():
+			LogError("❌ QUEUE: Message %s to <%s> rejected by %s: %s", msg.ID, st.Rcpt, server.SMTP.Username, st.Reply)
+			logDeliveryStatus(msg.ID, st.Rcpt, dsnFailed, st)
+			if msg.wants(st.Rcpt, "FAILURE") {
+				failed = append(failed, st)
+			}
+		default:
+			logDeliveryStatus(msg.ID, st.Rcpt, dsnDelayed, st)
+			remaining = append(remaining, st)
+		}
+	}
+	q.notify(msg, server, dsnFailed, failed, message)
+	q.notify(msg, server, dsnRelayed, relayed, message)
+	if delivered > 0 {
+		LogInfo("✅ QUEUE: Message %s delivered to %d recipients through %s", msg.ID, delivered, server.SMTP.Username)
+		if !msg.Bounce && !msg.SentSaved && server.IMAP != nil && server.IMAP.SaveSent {
+			q.sent.saveMessage(server, message)
+			msg.SentSaved = true
+		}
+	}
+	msg.To = nil
+	for _, st := range remaining {
+		msg.To = append(msg.To, st.Rcpt)
+	}
+	if len(remaining) == 0 {
+		q.remove(msg)
+		return
+	}
+	q.retryLater(msg, server, remaining, message)
+}
+
+// retryLater records a failed attempt for the remaining recipients and
+// schedules the next one, or bounces them once the message has been queued
+// longer than the expiry. The first deferral is reported to recipients that
+// asked for NOTIFY=DELAY.
+func (q *outboundQueue) retryLater(msg *queuedMessage, server *ServerConfig, remaining []deliveryStatus, message []byte) {
+	msg.Attempts++
+	msg.LastError = remaining[len(remaining)-1].Reply
+	expired := time.Since(msg.Received) >= q.cfg.Expire
+
+	var notify []deliveryStatus
+	for _, st := range remaining {
+		if expired && msg.wants(st.Rcpt, "FAILURE") || !expired && !msg.Delayed && msg.wants(st.Rcpt, "DELAY") {
+			notify = append(notify, st)
+		}
+	}
+	if expired {
+		LogError("❌ QUEUE: Message %s expired after %d attempts: %s", msg.ID, msg.Attempts, msg.LastError)
+		for _, st := range remaining {
+			logDeliveryStatus(msg.ID, st.Rcpt, dsnFailed, st)
+		}
+		q.notify(msg, server, dsnFailed, notify, message)
+		q.remove(msg)
+		return
+	}
+	if len(notify) > 0 {
+		q.notify(msg, server, dsnDelayed, notify, message)
+		msg.Delayed = true
+	}
+	delay := q.backoff(msg.Attempts)
+	msg.NextTry = time.Now().Add(delay)
+	if err := q.save(msg); err != nil {
+		LogError("Queue: %v", err)
+	}
+	log.Printf("[QUEUE] Message %s deferred (attempt %d): %s; next try in %v", msg.ID, msg.Attempts, msg.LastError, delay)
+}
+
+// backoff returns the delay after the given number of failed attempts:
+// retry_min, doubled after each attempt, up to retry_max
+func (q *outboundQueue) backoff(attempts int) time.Duration {
+	delay := q.cfg.RetryMin
+	for i := 1; i < attempts && delay < q.cfg.RetryMax; i++ {
+		delay *= 2
+	}
+	if delay > q.cfg.RetryMax {
+		delay = q.cfg.RetryMax
+	}
+	return delay
+}
+
+// notify sends a delivery status notification about statuses to the sender
+// of a message: appended to the INBOX of the account with bounce_to: inbox,
+// where POP3 clients see it, or queued to the sender through the same server.
+// Bounces themselves are never reported on.
+func (q *outboundQueue) notify(msg *queuedMessage, server *ServerConfig, action string, statuses []deliveryStatus, message []byte) {
+	if len(statuses) == 0 {
+		return
+	}
+	if msg.Bounce || msg.From == "" || server == nil {
+		LogError("Queue: not sending %s notification for message %s from <%s>", action, msg.ID, msg.From)
+		return
+	}
+	report := q.buildDSN(msg, server, action, statuses, message)
+
+	if q.cfg.BounceTo == "inbox" && server.IMAP != nil {
+		err := q.appendInbox(server.IMAP, report)
+		if err == nil {
+			LogInfo("📮 QUEUE: %s notification for message %s saved to the INBOX of %s", action, msg.ID, server.IMAP.Username)
+			log.Printf("[DSN] %s <%s>: %s notification saved to INBOX", msg.ID, msg.From, action)
+			return
+		}
+		LogError("Queue: saving %s notification for %s to INBOX failed, sending it instead: %v", action, msg.ID, err)
+	}
+
+	id, err := newQueueID()
+	if err != nil {
+		LogError("Queue: %v", err)
+		return
+	}
+	// Submission servers only accept the account itself as sender, so the
+	// notification does not use the null reverse path
+	dsn := &queuedMessage{ID: id, Server: msg.Server, From: server.SMTP.Username, To: []string{msg.From}, Received: time.Now(), Bounce: true}
+	if err := q.add(dsn, report); err != nil {
+		LogError("Queue: sending %s notification for %s: %v", action, msg.ID, err)
+		return
+	}
+	LogInfo("📮 QUEUE: %s notification %s for message %s queued to <%s>", action, id, msg.ID, msg.From)
+	log.Printf("[DSN] %s <%s>: %s notification queued as %s", msg.ID, msg.From, action, id)
+}
+
+// appendInbox stores a notification in the INBOX of the account
+func (q *outboundQueue) appendInbox(config *MailServerConfig, report []byte) error {
+	upstream, err := q.pool.get(config, "dsn")
+	if err != nil {
+		return err
+	}
+	defer q.pool.put(upstream)
+	return upstream.appendMessage("INBOX", "", report)
+}
+
+// newQueueID returns a random queue ID
+func newQueueID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(b[:])), nil
+}
+
+// relayMessage sends a message upstream through config and returns the reply
+// for every recipient. A failure before the recipients are reached is the
+// reply for all of them. The DSN parameters are passed on when the upstream
+// server has the DSN extension, which is reported as upstreamDSN.
+func relayMessage(config *MailServerConfig, timeouts TimeoutConfig, from string, to []string, dsn *dsnOptions, message []byte) (statuses []deliveryStatus, upstreamDSN bool) {
+	statuses = make([]deliveryStatus, len(to))
+	failAll := func(err error) ([]deliveryStatus, bool) {
+		code, reply := replyOf(err)
+		for i, rcpt := range to {
+			statuses[i] = deliveryStatus{Rcpt: rcpt, Code: code, Reply: reply}
+		}
+		return statuses, upstreamDSN
+	}
+
+	c, err := dialSMTP(config, timeouts)
+	if err != nil {
+		return failAll(err)
+	}
+	defer c.close()
+	_, upstreamDSN = c.extensions["DSN"]
+
+	var fromParams string
+	if upstreamDSN && dsn.Ret != "" {
+		fromParams += " RET=" + dsn.Ret
+	}
+	if upstreamDSN && dsn.EnvID != "" {
+		fromParams += " ENVID=" + dsn.EnvID
+	}
+	if _, _, err := c.cmd(250, "MAIL FROM:<%s>%s", from, fromParams); err != nil {
+		return failAll(err)
+	}
+	var accepted []int
+	for i, rcpt := range to {
+		var toParams string
+		if upstreamDSN && dsn.Notify[rcpt] != "" {
+			toParams += " NOTIFY=" + dsn.Notify[rcpt]
+		}
+		if upstreamDSN && dsn.ORcpt[rcpt] != "" {
+			toParams += " ORCPT=" + dsn.ORcpt[rcpt]
+		}
+		code, reply, err := c.cmd(25, "RCPT TO:<%s>%s", rcpt, toParams)
+		if err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return failAll(err)
+			}
+			code, reply := replyOf(err)
+			statuses[i] = deliveryStatus{Rcpt: rcpt, Code: code, Reply: reply}
+			continue
+		}
+		statuses[i] = deliveryStatus{Rcpt: rcpt, Code: code, Reply: reply}
+		accepted = append(accepted, i)
+	}
+	if len(accepted) == 0 {
+		c.cmd(250, "RSET")
+		return statuses, upstreamDSN
+	}
+
+	code, reply, err := c.data(message)
+	if err != nil {
+		code, reply = replyOf(err)
+	}
+	for _, i := range accepted {
+		// A recipient accepted with 251 (forwarded) keeps that reply once
+		// the message is accepted, as it says more than the DATA reply
+		if err == nil && statuses[i].Code != 250 {
+			continue
+		}
+		statuses[i].Code, statuses[i].Reply = code, reply
+	}
+	return statuses, upstreamDSN
+}
+
+// replyOf returns the SMTP reply code and text of a failed exchange; errors
+// that are not SMTP replies have code 0
+func replyOf(err error) (int, string) {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code, fmt.Sprintf("%d %s", smtpErr.Code, smtpErr.Msg)
+	}
+	return 0, err.Error()
+}
+
+// smtpClient is the SMTP client the queue relays messages with
+type smtpClient struct {
+	conn       net.Conn
+	text       *textproto.Conn
+	timeouts   TimeoutConfig
+	extensions map[string]string // EHLO keywords and their parameters
+}
+
+// dialSMTP connects and logs in to an upstream SMTP server, with implicit TLS
+// on port 465 and STARTTLS otherwise when use_tls is set
+func dialSMTP(config *MailServerConfig, timeouts TimeoutConfig) (*smtpClient, error) {
+	implicitTLS := config.Port == 465 && config.UseTLS
+	conn, err := dialUpstream(config, implicitTLS, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	c := &smtpClient{conn: conn, text: textproto.NewConn(conn), timeouts: timeouts}
+	if err := c.start(config, implicitTLS); err != nil {
+		c.text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *smtpClient) start(config *MailServerConfig, implicitTLS bool) error {
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return fmt.Errorf("greeting: %w", err)
+	}
+	if err := c.hello(); err != nil {
+		return err
+	}
+	if config.UseTLS && !implicitTLS {
+		if _, ok := c.extensions["STARTTLS"]; !ok {
+			return fmt.Errorf("%s does not offer STARTTLS", upstreamAddr(config))
+		}
+		if _, _, err := c.cmd(220, "STARTTLS"); err != nil {
+			return err
+		}
+		tlsConn, err := upstreamTLSHandshake(c.conn, config, c.timeouts)
+		if err != nil {
+			return err
+		}
+		c.conn = tlsConn
+		c.text = textproto.NewConn(tlsConn)
+		if err := c.hello(); err != nil {
+			return err
+		}
+	}
+	if config.Username == "" {
+		return nil
+	}
+	if _, _, err := c.cmd(334, "AUTH LOGIN"); err != nil {
+		return fmt.Errorf("AUTH: %w", err)
+	}
+	if _, _, err := c.cmd(334, "%s", base64.StdEncoding.EncodeToString([]byte(config.Username))); err != nil {
+		return fmt.Errorf("AUTH: %w", err)
+	}
+	if _, _, err := c.cmd(235, "%s", base64.StdEncoding.EncodeToString([]byte(config.Password))); err != nil {
+		return fmt.Errorf("AUTH: %w", err)
+	}
+	return nil
+}
+
+// hello sends EHLO and records the extensions the server offers
+func (c *smtpClient) hello() error {
+	_, reply, err := c.cmd(250, "EHLO proxy-mail")
+	if err != nil {
+		return fmt.Errorf("EHLO: %w", err)
+	}
+	c.extensions = make(map[string]string)
+	lines := strings.Split(reply, "\n")
+	for _, line := range lines[1:] {
+		keyword, params, _ := strings.Cut(line, " ")
+		c.extensions[strings.ToUpper(keyword)] = params
+	}
+	return nil
+}
+
+// cmd sends a command and returns the reply code and the reply as "code
+// text", or an error when the reply code does not start with expect
+func (c *smtpClient) cmd(expect int, format string, args ...any) (int, string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.text.ReadResponse(expect)
+	if err != nil {
+		return 0, "", err
+	}
+	return code, fmt.Sprintf("%d %s", code, msg), nil
+}
+
+// data sends the message, dot-stuffed, and returns the final reply like cmd
+func (c *smtpClient) data(message []byte) (int, string, error) {
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		return 0, "", err
+	}
+	if err := writeMessage(c.conn, message, -1); err != nil {
+		return 0, "", err
+	}
+	// RFC 5321 allows the server up to 10 minutes to accept the message
+	setUpstreamTimeout(c.conn, c.timeouts.UpstreamDataTermination)
+	defer setUpstreamTimeout(c.conn, c.timeouts.UpstreamResponse)
+	code, msg, err := c.text.ReadResponse(250)
+	if err != nil {
+		return 0, "", err
+	}
+	return code, fmt.Sprintf("%d %s", code, msg), nil
+}
+
+// close ends the session; the outcome of QUIT does not matter
+func (c *smtpClient) close() {
+	if c.text.PrintfLine("QUIT") == nil {
+		c.text.ReadResponse(221)
+	}
+	c.text.Close()
+}
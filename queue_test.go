@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an upstream SMTP server that answers RCPT with the reply set
+// for the recipient (250 by default) and DATA with dataReply
+type fakeSMTP struct {
+	dsn       bool // offer the DSN extension
+	rcpt      map[string]string
+	dataReply string
+
+	mu       sync.Mutex
+	commands []string
+	messages []string
+}
+
+// start serves the fake on a loopback port and returns a configuration for it
+func (f *fakeSMTP) start(t *testing.T) *MailServerConfig {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return &MailServerConfig{Host: "127.0.0.1", Port: addr.Port}
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 fake ESMTP\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO":
+			if f.dsn {
+				fmt.Fprint(conn, "250-fake\r\n250-DSN\r\n250 8BITMIME\r\n")
+			} else {
+				fmt.Fprint(conn, "250-fake\r\n250 8BITMIME\r\n")
+			}
+		case "RCPT":
+			addr := line[strings.IndexByte(line, '<')+1 : strings.IndexByte(line, '>')]
+			reply := f.rcpt[addr]
+			if reply == "" {
+				reply = "250 2.1.5 Ok"
+			}
+			fmt.Fprintf(conn, "%s\r\n", reply)
+		case "DATA":
+			fmt.Fprint(conn, "354 End data with <CR><LF>.<CR><LF>\r\n")
+			var message strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, message.String())
+			f.mu.Unlock()
+			fmt.Fprintf(conn, "%s\r\n", f.dataReply)
+		case "QUIT":
+			fmt.Fprint(conn, "221 Bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 2.0.0 Ok\r\n")
+		}
+	}
+}
+
+// envelope returns the MAIL and RCPT commands the fake received
+func (f *fakeSMTP) envelope() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var envelope []string
+	for _, command := range f.commands {
+		if strings.HasPrefix(command, "MAIL") || strings.HasPrefix(command, "RCPT") {
+			envelope = append(envelope, command)
+		}
+	}
+	return envelope
+}
+
+func TestRelayMessageStatuses(t *testing.T) {
+	upstream := &fakeSMTP{
+		rcpt: map[string]string{
+			"forward@example.com": "251 2.1.5 User not local; will forward",
+			"nouser@example.com":  "550 5.1.1 No such user",
+			"full@example.com":    "452 4.2.2 Mailbox full",
+		},
+		dataReply: "250 2.0.0 Ok: queued as 4F2A",
+	}
+	config := upstream.start(t)
+	to := []string{"ok@example.com", "forward@example.com", "nouser@example.com", "full@example.com"}
+
+	statuses, upstreamDSN := relayMessage(config, TimeoutConfig{}, "alice@example.com", to, &dsnOptions{}, []byte("Subject: x\r\n\r\n.dot\r\n"))
+	if upstreamDSN {
+		t.Error("DSN reported for a server without the extension")
+	}
+	want := []deliveryStatus{
+		{"ok@example.com", 250, "250 2.0.0 Ok: queued as 4F2A"},
+		{"forward@example.com", 251, "251 2.1.5 User not local; will forward"},
+		{"nouser@example.com", 550, "550 5.1.1 No such user"},
+		{"full@example.com", 452, "452 4.2.2 Mailbox full"},
+	}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Errorf("status %d: got %+v, want %+v", i, statuses[i], want[i])
+		}
+	}
+	if len(upstream.messages) != 1 || upstream.messages[0] != "Subject: x\r\n\r\n..dot\r\n" {
+		t.Errorf("upstream received %q", upstream.messages)
+	}
+}
+
+func TestRelayMessageDataRejected(t *testing.T) {
+	upstream := &fakeSMTP{
+		rcpt:      map[string]string{"nouser@example.com": "550 5.1.1 No such user"},
+		dataReply: "554 5.7.1 Message refused",
+	}
+	config := upstream.start(t)
+	statuses, _ := relayMessage(config, TimeoutConfig{}, "alice@example.com",
+		[]string{"a@example.com", "nouser@example.com", "b@example.com"}, &dsnOptions{}, []byte("Subject: x\r\n\r\nbody\r\n"))
+
+	// The DATA reply is the outcome for every recipient RCPT accepted
+	for i, code := range []int{554, 550, 554} {
+		if statuses[i].Code != code {
+			t.Errorf("%s: code %d, want %d (%s)", statuses[i].Rcpt, statuses[i].Code, code, statuses[i].Reply)
+		}
+	}
+	if statuses[0].Reply != "554 5.7.1 Message refused" {
+		t.Errorf("reply %q", statuses[0].Reply)
+	}
+}
+
+func TestRelayMessageUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	statuses, _ := relayMessage(&MailServerConfig{Host: "127.0.0.1", Port: port}, TimeoutConfig{},
+		"alice@example.com", []string{"a@example.com", "b@example.com"}, &dsnOptions{}, []byte("x"))
+	for _, st := range statuses {
+		if st.Code != 0 || st.delivered() || st.permanent() || !strings.Contains(st.Reply, "connect") {
+			t.Errorf("%s: %+v, want a temporary failure without a reply code", st.Rcpt, st)
+		}
+	}
+}
+
+func TestRelayMessageDSNParameters(t *testing.T) {
+	dsn := &dsnOptions{
+		Ret:    "HDRS",
+		EnvID:  "QQ314159",
+		Notify: map[string]string{"a@example.com": "SUCCESS,FAILURE"},
+		ORcpt:  map[string]string{"a@example.com": "rfc822;a+2Bx@example.com"},
+	}
+	for _, offered := range []bool{true, false} {
+		upstream := &fakeSMTP{dsn: offered, dataReply: "250 Ok"}
+		config := upstream.start(t)
+		_, upstreamDSN := relayMessage(config, TimeoutConfig{}, "alice@example.com", []string{"a@example.com", "b@example.com"}, dsn, []byte("x\r\n"))
+		if upstreamDSN != offered {
+			t.Errorf("DSN offered %v, reported %v", offered, upstreamDSN)
+		}
+
+		want := []string{"MAIL FROM:<alice@example.com>", "RCPT TO:<a@example.com>", "RCPT TO:<b@example.com>"}
+		if offered {
+			want[0] += " RET=HDRS ENVID=QQ314159"
+			want[1] += " NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;a+2Bx@example.com"
+		}
+		if got := upstream.envelope(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("DSN offered %v: envelope %q, want %q", offered, got, want)
+		}
+	}
+}
+
+// testQueue returns a queue on a temporary spool without its delivery worker
+func testQueue(t *testing.T, cfg QueueConfig) *outboundQueue {
+	t.Helper()
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	cfg.applyDefaults()
+	return &outboundQueue{
+		cfg:      cfg,
+		config:   &Config{Queue: cfg},
+		messages: make(map[string]*queuedMessage),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+}
+
+func TestQueueLoad(t *testing.T) {
+	q := testQueue(t, QueueConfig{})
+	server := &ServerConfig{Name: "a", SMTP: &MailServerConfig{Username: "alice@example.com"}}
+	id, err := q.enqueue(server, "alice@example.com", []string{"bob@example.com"}, dsnOptions{Ret: "FULL"}, "192.0.2.1", []byte("Subject: x\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leftovers of a crash: a message that was never acknowledged, a partial
+	// write, an envelope that lost its message and one that is unreadable
+	files := map[string]string{
+		"UNACKED.eml":      "Subject: y\r\n\r\n",
+		"PARTIAL.json.tmp": "{",
+		"LOST.json":        `{"id": "LOST", "server": "a"}`,
+		"BROKEN.json":      "not json",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(q.cfg.Dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted := testQueue(t, QueueConfig{Dir: q.cfg.Dir})
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.messages) != 1 {
+		t.Fatalf("%d messages loaded, want 1", len(restarted.messages))
+	}
+	msg := restarted.messages[id]
+	if msg == nil || msg.From != "alice@example.com" || msg.To[0] != "bob@example.com" || msg.Ret != "FULL" || msg.Client != "192.0.2.1" {
+		t.Errorf("loaded %+v", msg)
+	}
+	for name, kept := range map[string]bool{"UNACKED.eml": false, "PARTIAL.json.tmp": false, "LOST.json": false, "BROKEN.json": true} {
+		if _, err := os.Stat(filepath.Join(q.cfg.Dir, name)); (err == nil) != kept {
+			t.Errorf("%s: kept %v, want %v", name, err == nil, kept)
+		}
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := testQueue(t, QueueConfig{RetryMin: time.Minute, RetryMax: 10 * time.Minute})
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, delay := range want {
+		if got := q.backoff(i + 1); got != delay {
+			t.Errorf("after %d attempts: %v, want %v", i+1, got, delay)
+		}
+	}
+	if got := q.backoff(1000); got != 10*time.Minute {
+		t.Errorf("after 1000 attempts: %v", got)
+	}
+}
+
+func TestQueueRetryLater(t *testing.T) {
+	q := testQueue(t, QueueConfig{RetryMin: time.Minute, Expire: time.Hour})
+	server := &ServerConfig{Name: "a", SMTP: &MailServerConfig{Host: "smtp.example.com", Username: "alice@example.com"}}
+	message := []byte("Subject: x\r\n\r\nbody\r\n")
+	deferred := []deliveryStatus{{Rcpt: "bob@example.com", Code: 451, Reply: "451 4.3.0 Try again later"}}
+
+	msg := &queuedMessage{ID: "RETRY", Server: "a", From: "alice@example.com", To: []string{"bob@example.com"}, Received: time.Now()}
+	if err := q.add(msg, message); err != nil {
+		t.Fatal(err)
+	}
+	q.retryLater(msg, server, deferred, message)
+	q.retryLater(msg, server, deferred, message)
+	if msg.Attempts != 2 || msg.LastError != "451 4.3.0 Try again later" {
+		t.Errorf("after two attempts: %+v", msg)
+	}
+	if next := time.Until(msg.NextTry); next < time.Minute || next > 2*time.Minute {
+		t.Errorf("next try in %v, want 2m", next)
+	}
+	if len(q.messages) != 1 {
+		t.Errorf("a deferral without NOTIFY=DELAY sent a notification")
+	}
+
+	// Once queued longer than the expiry, the message is bounced and removed
+	msg.Received = time.Now().Add(-time.Hour)
+	q.retryLater(msg, server, deferred, message)
+	if _, ok := q.messages["RETRY"]; ok {
+		t.Error("expired message still queued")
+	}
+	if _, err := os.Stat(q.messagePath(msg)); !os.IsNotExist(err) {
+		t.Error("expired message left in the spool")
+	}
+	if len(q.messages) != 1 {
+		t.Fatalf("%d messages queued, want only the bounce", len(q.messages))
+	}
+	for _, bounce := range q.messages {
+		if !bounce.Bounce || bounce.To[0] != "alice@example.com" {
+			t.Errorf("bounce %+v", bounce)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// sentFolderNames are tried, in order, on servers that mark no folder \Sent
+var sentFolderNames = []string{"Sent", "Sent Items", "Sent Messages", "INBOX.Sent"}
+
+// sentCopier stores copies of messages sent through the SMTP listeners in the
+// Sent folder of the same account, for providers that do not do it themselves
+type sentCopier struct {
+	pool *imapPool
+
+	mu      sync.Mutex
+	folders map[string]string // detected Sent folder by loginKey
+	wg      sync.WaitGroup
+}
+
+func newSentCopier(pool *imapPool) *sentCopier {
+	return &sentCopier{pool: pool, folders: make(map[string]string)}
+}
+
+// save appends a sent message to the Sent folder of the server in the
+// background, so the SMTP client does not wait for it. data is the message
+// as received after DATA.
+func (sc *sentCopier) save(server *ServerConfig, data []byte) {
+	sc.saveMessage(server, unstuffData(data))
+}
+
+// saveMessage is save for a message that is not dot-stuffed
+func (sc *sentCopier) saveMessage(server *ServerConfig, message []byte) {
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		if err := sc.appendSent(server.IMAP, message); err != nil {
+			LogError("Saving sent message to %s (%s) failed: %v", server.IMAP.Username, server.Name, err)
+		}
+	}()
+}
+
+// close waits for copies in progress
+func (sc *sentCopier) close() {
+	sc.wg.Wait()
+}
+
+func (sc *sentCopier) appendSent(config *MailServerConfig, message []byte) error {
+	upstream, err := sc.pool.get(config, "sent")
+	if err != nil {
+		return err
+	}
+	defer sc.pool.put(upstream)
+
+	folder, err := sc.sentFolder(upstream, config)
+	if err != nil {
+		return err
+	}
+	if err := upstream.appendMessage(folder, `\Seen`, message); err != nil {
+		return err
+	}
+	LogInfo("📤 SENT COPY: Message (%d bytes) saved to %s of %s", len(message), folder, config.Username)
+	return nil
+}
+
+// sentFolder returns the configured Sent folder, or finds it by its SPECIAL-USE
+// attribute (RFC 6154) or a common name
+func (sc *sentCopier) sentFolder(upstream *imapClient, config *MailServerConfig) (string, error) {
+	if config.SentFolder != "" {
+		return config.SentFolder, nil
+	}
+	key := loginKey(config)
+	sc.mu.Lock()
+	folder := sc.folders[key]
+	sc.mu.Unlock()
+	if folder != "" {
+		return folder, nil
+	}
+
+	mailboxes, err := upstream.listFolders("*")
+	if err != nil {
+		return "", err
+	}
+	for _, mailbox := range mailboxes {
+		if mailbox.hasAttribute(`\Sent`) && !mailbox.hasAttribute(`\Noselect`) {
+			folder = mailbox.Name
+			break
+		}
+	}
+	for _, name := range sentFolderNames {
+		if folder != "" {
+			break
+		}
+		for _, mailbox := range mailboxes {
+			if strings.EqualFold(mailbox.Name, name) && !mailbox.hasAttribute(`\Noselect`) {
+				folder = mailbox.Name
+				break
+			}
+		}
+	}
+	if folder == "" {
+		return "", fmt.Errorf("no Sent folder found; set sent_folder")
+	}
+	sc.mu.Lock()
+	sc.folders[key] = folder
+	sc.mu.Unlock()
+	return folder, nil
+}
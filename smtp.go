@@ -27,30 +27,71 @@ func detectCharset(headers []byte) string {
 }
 
 type SMTPServer struct {
-	config   *Config
-	listener net.Listener
-	wg       sync.WaitGroup
-	stopping bool
+	config         *Config
+	listenerConfig ListenerConfig
+	shared         *sharedState
+	filter         *ipFilter
+	proxyTrusted   cidrList
+	legacyFilter   *ipFilter // clients allowed to send without AUTH
+	tlsConfig      *tls.Config
+	listener       net.Listener
+	wg             sync.WaitGroup
+	stopping       bool
 }
 
-func NewSMTPServer(config *Config) *SMTPServer {
+func NewSMTPServer(config *Config, listenerConfig ListenerConfig, shared *sharedState) *SMTPServer {
 	return &SMTPServer{
-		config: config,
+		config:         config,
+		listenerConfig: listenerConfig,
+		shared:         shared,
 	}
 }
 
-func (s *SMTPServer) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.config.Local.SMTP.Host, s.config.Local.SMTP.Port)
-	listener, err := net.Listen("tcp", addr)
+// Listen prepares the listener's policy and binds its socket, so that the
+// service can report readiness before Start begins accepting clients
+func (s *SMTPServer) Listen() error {
+	filter, err := newIPFilter(s.listenerConfig.Allow, s.listenerConfig.Deny)
+	if err != nil {
+		return fmt.Errorf("invalid client networks for listener %s: %w", s.listenerConfig.Name, err)
+	}
+	s.filter = filter
+	legacyFilter, err := newIPFilter(s.listenerConfig.LegacyAllow, nil)
+	if err != nil {
+		return fmt.Errorf("invalid legacy_allow networks for listener %s: %w", s.listenerConfig.Name, err)
+	}
+	s.legacyFilter = legacyFilter
+
+	s.proxyTrusted, err = parseCIDRList(s.listenerConfig.ProxyTrusted)
+	if err != nil {
+		return fmt.Errorf("invalid proxy_trusted networks for listener %s: %w", s.listenerConfig.Name, err)
+	}
+
+	s.tlsConfig, err = localTLSConfig(s.listenerConfig)
 	if err != nil {
-		return fmt.Errorf("failed to start SMTP server on %s: %w", addr, err)
+		return err
+	}
+
+	listener, err := listenLocal(s.listenerConfig, s.shared.sockets)
+	if err != nil {
+		return fmt.Errorf("failed to start SMTP server %s: %w", s.listenerConfig.Name, err)
 	}
 
 	s.listener = listener
-	log.Printf("[SMTP] Proxy server listening on %s", addr)
+	log.Printf("[SMTP] Proxy server %s listening on %s (TLS: %v, STARTTLS: %v, AUTH required: %v)", s.listenerConfig.Name,
+		listener.Addr(), s.listenerConfig.UseTLS, s.listenerConfig.StartTLS, s.listenerConfig.RequireAuth)
+	return nil
+}
+
+// Start accepts clients until Stop is called
+func (s *SMTPServer) Start() error {
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
+	}
 
 	for !s.stopping {
-		conn, err := listener.Accept()
+		conn, err := s.listener.Accept()
 		if err != nil {
 			if s.stopping {
 				break
@@ -76,9 +117,41 @@ func (s *SMTPServer) Stop() error {
 	return nil
 }
 
-func (s *SMTPServer) handleConnection(localConn net.Conn) {
+func (s *SMTPServer) handleConnection(conn net.Conn) {
 	defer s.wg.Done()
-	defer localConn.Close()
+	defer conn.Close()
+
+	// Admission checks run after the PROXY header so they see the real client.
+	// The allow/deny lists come first: denied clients get neither a TLS
+	// handshake nor a connection slot.
+	localConn, err := readClientProxy(conn, s.listenerConfig, s.proxyTrusted)
+	if err != nil {
+		LogInfo("[SMTP] Dropping connection on %s: %v", s.listenerConfig.Name, err)
+		return
+	}
+	ip := clientIP(localConn)
+	if !s.filter.permits(ip) {
+		LogInfo("[SMTP] Refusing client %s: address not allowed", localConn.RemoteAddr())
+		if !s.listenerConfig.UseTLS { // a TLS client could not read a plain-text reply
+			rejectConnection(localConn, "554 5.7.1 Access denied")
+		}
+		return
+	}
+	if localConn, err = startClientTLS(localConn, s.listenerConfig, s.tlsConfig); err != nil {
+		LogInfo("[SMTP] Dropping connection on %s: %v", s.listenerConfig.Name, err)
+		return
+	}
+	if s.shared.guard.bannedIP(ip) {
+		LogInfo("[SMTP] Refusing connection from banned address %s", localConn.RemoteAddr())
+		rejectConnection(localConn, "421 4.7.0 Too many failed logins, try again later")
+		return
+	}
+	if err := s.shared.conns.acquire(ip); err != nil {
+		LogInfo("[SMTP] Refusing connection from %s: %v", localConn.RemoteAddr(), err)
+		rejectConnection(localConn, "421 4.7.0 Too many connections, try again later")
+		return
+	}
+	defer s.shared.conns.release(ip)
 
 	clientAddr := localConn.RemoteAddr().String()
 	LogInfo("📧 SMTP: Client connected from %s", clientAddr)
@@ -98,9 +171,14 @@ type smtpState struct {
 	authState       string // "", "username", "password"
 	mailboxName     string // for logging context
 	upstreamConn    net.Conn
+	upstreamLogin   *MailServerConfig // login slot held for upstreamConn
 	serverConfig    *ServerConfig
 	inDataMode      bool   // track DATA command state
 	heloHost        string // store HELO hostname for legacy clients
+	mailFrom        string   // envelope of the current transaction, for the journal
+	rcptTo          []string // recipients the upstream server accepted
+	dsn             dsnOptions // DSN parameters of the current transaction, for the queue
+	upstreamDSN     bool       // upstreamConn offers the DSN extension
 }
 
 // getMailboxIdentifier returns a string identifier for the current mailbox for logging
@@ -115,26 +193,26 @@ func (s *smtpState) getMailboxIdentifier() string {
 }
 
 // handleSMTPDataMode handles the DATA command in binary-safe mode
-// to preserve original email encoding
-func (s *SMTPServer) handleSMTPDataMode(localConn net.Conn, upstreamConn net.Conn, clientAddr string, mailboxName string) error {
-	// Read raw bytes using a larger buffer for efficiency
-	reader := bufio.NewReaderSize(localConn, 32*1024)
+// to preserve original email encoding. It returns the data as forwarded,
+// including the final dot line. With a nil upstreamConn the data is only
+// read, for the outbound queue. reader is the session's reader of localConn,
+// which may already hold pipelined data.
+func (s *SMTPServer) handleSMTPDataMode(localConn net.Conn, reader *bufio.Reader, upstreamConn net.Conn, clientAddr string, mailboxName string) ([]byte, error) {
 	var messageBuffer bytes.Buffer
 	var headerBuffer bytes.Buffer
 	inHeaders := true
 	var charset string
 
-	// Use a timeout for reading the entire message
-	if err := localConn.SetReadDeadline(time.Now().Add(5 * time.Minute)); err != nil {
-		return fmt.Errorf("failed to set read deadline: %v", err)
-	}
-	defer localConn.SetReadDeadline(time.Time{})
-
 	for {
+		// RFC 5321 data block timeout: restarted for every line received
+		if err := localConn.SetReadDeadline(time.Now().Add(s.config.Timeouts.SMTPData)); err != nil {
+			return nil, fmt.Errorf("failed to set read deadline: %w", err)
+		}
+
 		// Read line as raw bytes
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
-			return fmt.Errorf("error reading message data: %v", err)
+			return nil, fmt.Errorf("error reading message data: %w", err)
 		}
 
 		// Still collecting headers
@@ -158,9 +236,12 @@ func (s *SMTPServer) handleSMTPDataMode(localConn net.Conn, upstreamConn net.Con
 		if len(line) == 3 && line[0] == '.' && line[1] == '\r' && line[2] == '\n' {
 			// Found the end marker
 			if messageBuffer.Len() > 3 {
+				if upstreamConn == nil {
+					return messageBuffer.Bytes(), nil
+				}
 				// Forward the complete message to upstream
 				if _, err := upstreamConn.Write(messageBuffer.Bytes()); err != nil {
-					return fmt.Errorf("error forwarding message to upstream: %v", err)
+					return nil, fmt.Errorf("error forwarding message to upstream: %w", err)
 				}
 				LogInfo("📧 Forwarded message (%d bytes) with original encoding%s", 
 					messageBuffer.Len(),
@@ -170,7 +251,7 @@ func (s *SMTPServer) handleSMTPDataMode(localConn net.Conn, upstreamConn net.Con
 						}
 						return ""
 					}())
-				return nil
+				return messageBuffer.Bytes(), nil
 			}
 		}
 	}
@@ -188,14 +269,23 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 	defer func() {
 		if state.upstreamConn != nil {
 			LogDebug("[%s] Closing upstream connection for client %s", state.getMailboxIdentifier(), clientAddr)
-			state.upstreamConn.Close()
+			s.closeUpstream(state)
 		}
 	}()
 
 	for {
+		// RFC 5321 server timeout while waiting for the next command
+		localConn.SetReadDeadline(time.Now().Add(s.config.Timeouts.SMTPCommand))
+
 		// Read line from client
 		lineBytes, err := clientReader.ReadBytes('\n')
 		if err != nil {
+			if isTimeout(err) {
+				fmt.Fprintf(localConn, "421 4.4.2 Timeout waiting for command, closing connection\r\n")
+				LogInfo("[%s] SMTP client %s idle for more than %v, closing connection",
+					state.getMailboxIdentifier(), clientAddr, s.config.Timeouts.SMTPCommand)
+				break
+			}
 			LogDebug("[%s] SMTP client %s disconnected: %v", state.getMailboxIdentifier(), clientAddr, err)
 			break
 		}
@@ -226,12 +316,29 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 		switch command {
 		case "EHLO", "HELO":
 			// Send capabilities, making AUTH more prominent
-			fmt.Fprintf(localConn, "250-Proxy-Mail SMTP Ready\r\n")
-			fmt.Fprintf(localConn, "250-SIZE 35882577\r\n")  // Add common SMTP extensions
-			fmt.Fprintf(localConn, "250-8BITMIME\r\n")
-			fmt.Fprintf(localConn, "250-PIPELINING\r\n")
-			fmt.Fprintf(localConn, "250-AUTH LOGIN PLAIN\r\n")  // Make AUTH more visible
-			fmt.Fprintf(localConn, "250 STARTTLS\r\n")
+			capabilities := []string{
+				"Proxy-Mail SMTP Ready",
+				"SIZE 35882577", // Add common SMTP extensions
+				"8BITMIME",
+				"PIPELINING",
+			}
+			if s.shared.queue != nil {
+				// Only the queue can report on messages the upstream server does not
+				capabilities = append(capabilities, "DSN")
+			}
+			if !s.listenerConfig.RequireTLS || isTLSConn(localConn) {
+				capabilities = append(capabilities, "AUTH LOGIN PLAIN") // Make AUTH more visible
+			}
+			if s.tlsConfig != nil && s.listenerConfig.StartTLS && !isTLSConn(localConn) {
+				capabilities = append(capabilities, "STARTTLS")
+			}
+			for i, capability := range capabilities {
+				separator := "-"
+				if i == len(capabilities)-1 {
+					separator = " "
+				}
+				fmt.Fprintf(localConn, "250%s%s\r\n", separator, capability)
+			}
 			LogDebug("[%s] SMTP sent enhanced capabilities to client %s", state.getMailboxIdentifier(), clientAddr)
 
 			// For HELO, we might need to handle legacy clients differently
@@ -243,12 +350,39 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				LogDebug("[%s] Client using legacy HELO command, hostname: %s", state.getMailboxIdentifier(), state.heloHost)
 			}
 
+		case "STARTTLS":
+			// RFC 3207
+			if s.tlsConfig == nil || !s.listenerConfig.StartTLS || isTLSConn(localConn) {
+				fmt.Fprintf(localConn, "502 5.5.1 STARTTLS not available\r\n")
+				continue
+			}
+			fmt.Fprintf(localConn, "220 2.0.0 Ready to start TLS\r\n")
+			tlsConn := tls.Server(localConn, s.tlsConfig)
+			tlsConn.SetDeadline(time.Now().Add(localTLSHandshakeTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				LogError("[%s] STARTTLS handshake with client %s failed: %v", state.getMailboxIdentifier(), clientAddr, err)
+				return
+			}
+			tlsConn.SetDeadline(time.Time{})
+			localConn = tlsConn
+			clientReader = bufio.NewReader(localConn)
+
+			// The client must start over after STARTTLS
+			s.closeUpstream(state)
+			*state = smtpState{}
+			LogInfo("📧 SMTP: Client %s upgraded to TLS", clientAddr)
+
 		case "AUTH":
 			if len(fields) < 2 {
 				fmt.Fprintf(localConn, "501 Syntax error\r\n")
 				continue
 			}
 
+			if s.listenerConfig.RequireTLS && !isTLSConn(localConn) {
+				fmt.Fprintf(localConn, "538 5.7.11 Encryption required for requested authentication mechanism\r\n")
+				continue
+			}
+
 			authType := strings.ToUpper(fields[1])
 			if authType == "LOGIN" {
 				fmt.Fprintf(localConn, "334 VXNlcm5hbWU6\r\n") // Base64 for "Username:"
@@ -269,8 +403,20 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				continue
 			}
 
+			ret, envid, err := mailParams(line)
+			if err != nil {
+				fmt.Fprintf(localConn, "501 5.5.4 %v\r\n", err)
+				continue
+			}
+
 			// Check if using legacy authentication (no explicit AUTH)
 			if !state.isAuthenticated {
+				if s.listenerConfig.RequireAuth || !s.legacyFilter.permits(clientIP(localConn)) {
+					fmt.Fprintf(localConn, "530 5.7.0 Authentication required\r\n")
+					LogInfo("[%s] Client %s must authenticate before sending", state.getMailboxIdentifier(), clientAddr)
+					continue
+				}
+
 				// Find matching server config - try to match by sender, or use any available SMTP server
 				serverConfig := s.findServerConfigBySender(senderEmail)
 				if serverConfig == nil {
@@ -287,7 +433,7 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				LogInfo("[%s] Auto-authenticated legacy client %s for sender: %s", state.mailboxName, clientAddr, senderEmail)
 			} else {
 				// For explicitly authenticated clients, verify sender matches authenticated user
-				if senderEmail != state.authUsername {
+				if senderEmail != state.authUsername && senderEmail != state.serverConfig.SMTP.Username {
 					LogError("[%s] Sender mismatch: authenticated as %s but trying to send as %s",
 						state.mailboxName, state.authUsername, senderEmail)
 					fmt.Fprintf(localConn, "550 Sender address must match authenticated user\r\n")
@@ -297,25 +443,41 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 			
 			LogInfo("[%s] SMTP processing MAIL FROM command", state.mailboxName)
 			
+			// Queued messages are accepted locally and relayed later
+			if s.shared.queue != nil {
+				state.mailFrom = senderEmail
+				state.rcptTo = nil
+				state.dsn = dsnOptions{Ret: ret, EnvID: envid, Notify: make(map[string]string), ORcpt: make(map[string]string)}
+				fmt.Fprintf(localConn, "250 2.1.0 Ok\r\n")
+				continue
+			}
+
 			// Connect to upstream if not already connected
 			if state.upstreamConn == nil {
 				LogInfo("[%s] Establishing new upstream connection for MAIL FROM command", state.mailboxName)
+				if !s.shared.logins.acquire(state.serverConfig.SMTP) {
+					LogError("[%s] Too many simultaneous upstream logins for mailbox %s, refusing client %s",
+						state.mailboxName, state.serverConfig.SMTP.Username, clientAddr)
+					fmt.Fprintf(localConn, "421 4.7.0 Too many sessions for this mailbox, try again later\r\n")
+					return
+				}
 				var err error
 				state.upstreamConn, err = s.connectToUpstream(state.serverConfig, clientAddr)
 				if err != nil {
+					s.shared.logins.release(state.serverConfig.SMTP)
 					LogError("[%s] Failed to connect to upstream server: %v", state.mailboxName, err)
-					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+					fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 					continue
 				}
+				state.upstreamLogin = state.serverConfig.SMTP
 
 				// Read initial greeting
 				upstreamReader := bufio.NewReader(state.upstreamConn)
 				greeting, err := upstreamReader.ReadString('\n')
 				if err != nil {
 					LogError("[%s] Failed to read upstream greeting: %v", state.mailboxName, err)
-					state.upstreamConn.Close()
-					state.upstreamConn = nil
-					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+					s.closeUpstream(state)
+					fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 					continue
 				}
 				LogDebug("[%s] UPSTREAM greeting: %s", state.mailboxName, strings.TrimSpace(greeting))
@@ -326,23 +488,31 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				LogInfo("[%s] Initiating SMTP handshake with upstream server", state.mailboxName)
 				
 				// Read multi-line EHLO response
+				var ehloErr error
+				state.upstreamDSN = false
 				for {
 					response, err := upstreamReader.ReadString('\n')
 					if err != nil {
-						LogError("[%s] Failed to read EHLO response: %v", state.mailboxName, err)
-						state.upstreamConn.Close()
-						state.upstreamConn = nil
-						fmt.Fprintf(localConn, "451 Local error in processing\r\n")
-						continue
+						ehloErr = err
+						break
 					}
 					
 					respText := strings.TrimSpace(response)
 					LogDebug("[%s] UPSTREAM -> PROXY: %s", state.mailboxName, respText)
+					if len(respText) > 4 && strings.EqualFold(strings.Fields(respText[4:]+" ")[0], "DSN") {
+						state.upstreamDSN = true
+					}
 					
 					if len(respText) > 3 && respText[3] == ' ' {
 						break  // End of multi-line response
 					}
 				}
+				if ehloErr != nil {
+					LogError("[%s] Failed to read EHLO response: %v", state.mailboxName, ehloErr)
+					s.closeUpstream(state)
+					fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(ehloErr))
+					continue
+				}
 
 				// Authenticate with upstream
 				fmt.Fprintf(state.upstreamConn, "AUTH LOGIN\r\n")
@@ -351,9 +521,8 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				response, err := upstreamReader.ReadString('\n')
 				if err != nil {
 					LogError("[%s] Failed to read AUTH response: %v", state.mailboxName, err)
-					state.upstreamConn.Close()
-					state.upstreamConn = nil
-					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+					s.closeUpstream(state)
+					fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 					continue
 				}
 				
@@ -362,8 +531,7 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				
 				if !strings.HasPrefix(respText, "334") {
 					LogError("[%s] Upstream AUTH failed: %s", state.mailboxName, respText)
-					state.upstreamConn.Close()
-					state.upstreamConn = nil
+					s.closeUpstream(state)
 					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
 					continue
 				}
@@ -376,9 +544,8 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				response, err = upstreamReader.ReadString('\n')
 				if err != nil {
 					LogError("[%s] Failed to read username response: %v", state.mailboxName, err)
-					state.upstreamConn.Close()
-					state.upstreamConn = nil
-					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+					s.closeUpstream(state)
+					fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 					continue
 				}
 				
@@ -387,8 +554,7 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				
 				if !strings.HasPrefix(respText, "334") {
 					LogError("[%s] Upstream username failed: %s", state.mailboxName, respText)
-					state.upstreamConn.Close()
-					state.upstreamConn = nil
+					s.closeUpstream(state)
 					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
 					continue
 				}
@@ -401,9 +567,8 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				response, err = upstreamReader.ReadString('\n')
 				if err != nil {
 					LogError("[%s] Failed to read password response: %v", state.mailboxName, err)
-					state.upstreamConn.Close()
-					state.upstreamConn = nil
-					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+					s.closeUpstream(state)
+					fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 					continue
 				}
 				
@@ -412,8 +577,7 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				
 				if !strings.HasPrefix(respText, "235") {
 					LogError("[%s] Upstream authentication failed: %s", state.mailboxName, respText)
-					state.upstreamConn.Close()
-					state.upstreamConn = nil
+					s.closeUpstream(state)
 					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
 					continue
 				}
@@ -422,7 +586,11 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				LogInfo("[%s] Ready to send email from %s", state.mailboxName, state.authUsername)
 			}
 
-			// Forward MAIL FROM command to upstream
+			// Forward MAIL FROM command to upstream, without the DSN
+			// parameters if the upstream server does not know them
+			if !state.upstreamDSN {
+				line = stripDSNParams(line, "FROM:")
+			}
 			fmt.Fprintf(state.upstreamConn, "%s\r\n", line)
 			LogDebug("[%s] PROXY -> UPSTREAM: %s", state.mailboxName, line)
 			
@@ -431,7 +599,7 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 			response, err := upstreamReader.ReadString('\n')
 			if err != nil {
 				LogError("[%s] Failed to read MAIL FROM response: %v", state.mailboxName, err)
-				fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+				fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 				continue
 			}
 			
@@ -439,14 +607,42 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 			fmt.Fprintf(localConn, "%s", response)
 			respText := strings.TrimSpace(response)
 			LogDebug("[%s] UPSTREAM -> CLIENT: %s", state.mailboxName, respText)
+			if strings.HasPrefix(respText, "2") {
+				state.mailFrom = senderEmail
+				state.rcptTo = nil
+			}
 
 		case "RCPT":
+			if s.shared.queue != nil && state.isAuthenticated {
+				if state.mailFrom == "" {
+					fmt.Fprintf(localConn, "503 5.5.1 Need MAIL command\r\n")
+					continue
+				}
+				rcpt := extractAddress(line, "TO:")
+				if rcpt == "" {
+					fmt.Fprintf(localConn, "501 5.1.3 Invalid RCPT TO format\r\n")
+					continue
+				}
+				notify, orcpt, err := rcptParams(line)
+				if err != nil {
+					fmt.Fprintf(localConn, "501 5.5.4 %v\r\n", err)
+					continue
+				}
+				state.rcptTo = append(state.rcptTo, rcpt)
+				state.dsn.Notify[rcpt] = notify
+				state.dsn.ORcpt[rcpt] = orcpt
+				fmt.Fprintf(localConn, "250 2.1.5 Ok\r\n")
+				continue
+			}
 			if !state.isAuthenticated || state.upstreamConn == nil {
 				fmt.Fprintf(localConn, "530 Authentication required\r\n")
 				continue
 			}
 
 			// Forward RCPT TO command to upstream
+			if !state.upstreamDSN {
+				line = stripDSNParams(line, "TO:")
+			}
 			fmt.Fprintf(state.upstreamConn, "%s\r\n", line)
 			LogDebug("[%s] PROXY -> UPSTREAM: %s", state.mailboxName, line)
 			
@@ -455,7 +651,7 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 			response, err := upstreamReader.ReadString('\n')
 			if err != nil {
 				LogError("[%s] Failed to read RCPT TO response: %v", state.mailboxName, err)
-				fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+				fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 				continue
 			}
 			
@@ -463,8 +659,20 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 			fmt.Fprintf(localConn, "%s", response)
 			respText := strings.TrimSpace(response)
 			LogDebug("[%s] UPSTREAM -> CLIENT: %s", state.mailboxName, respText)
+			if strings.HasPrefix(respText, "2") {
+				state.rcptTo = append(state.rcptTo, extractAddress(line, "TO:"))
+			} else {
+				st := replyStatus(extractAddress(line, "TO:"), respText)
+				logDeliveryStatus("direct", st.Rcpt, st.action(), st)
+			}
 
 		case "DATA":
+			if s.shared.queue != nil && state.isAuthenticated {
+				if !s.queueData(localConn, clientReader, state, clientAddr) {
+					return
+				}
+				continue
+			}
 			if !state.isAuthenticated || state.upstreamConn == nil {
 				fmt.Fprintf(localConn, "530 Authentication required\r\n")
 				continue
@@ -479,7 +687,7 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 			response, err := upstreamReader.ReadString('\n')
 			if err != nil {
 				LogError("[%s] Failed to read DATA response: %v", state.mailboxName, err)
-				fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+				fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 				continue
 			}
 			
@@ -494,27 +702,46 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				LogInfo("[%s] Email transmission in progress...", state.mailboxName)
 				
 				// Use binary-safe DATA handling to preserve original encoding
-				if err := s.handleSMTPDataMode(localConn, state.upstreamConn, clientAddr, state.mailboxName); err != nil {
+				data, err := s.handleSMTPDataMode(localConn, clientReader, state.upstreamConn, clientAddr, state.mailboxName)
+				if err != nil {
 					LogError("[%s] Error in DATA mode: %v", state.mailboxName, err)
-					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
-					continue
+					// The upstream transaction is left half-finished, so the
+					// session cannot continue either way
+					if isTimeout(err) {
+						fmt.Fprintf(localConn, "421 4.4.2 Timeout waiting for data, closing connection\r\n")
+					} else {
+						fmt.Fprintf(localConn, "421 4.3.0 Local error in processing, closing connection\r\n")
+					}
+					return
 				}
 				
 				// Read the response from upstream after data transmission
+				// (RFC 5321 allows the server up to 10 minutes to accept the message)
+				setUpstreamTimeout(state.upstreamConn, s.config.Timeouts.UpstreamDataTermination)
 				response, err = upstreamReader.ReadString('\n')
+				setUpstreamTimeout(state.upstreamConn, s.config.Timeouts.UpstreamResponse)
 				if err != nil {
 					LogError("[%s] Failed to read upstream response: %v", state.mailboxName, err)
-					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+					s.recordJournal(localConn, state, data, "no response: "+err.Error())
+					fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 					continue
 				}
 				
 				respText = strings.TrimSpace(response)
+				for _, rcpt := range state.rcptTo {
+					st := replyStatus(rcpt, respText)
+					logDeliveryStatus("direct", rcpt, st.action(), st)
+				}
+				s.recordJournal(localConn, state, data, respText)
 				LogDebug("[%s] UPSTREAM -> PROXY: %s", state.mailboxName, respText)
 				fmt.Fprintf(localConn, "%s\r\n", respText)
 				
 				if strings.HasPrefix(respText, "250") {
 					LogInfo("✅ Email sent successfully from %s", state.mailboxName)
 					LogInfo("[%s] SMTP transaction completed successfully", state.mailboxName)
+					if state.serverConfig.IMAP != nil && state.serverConfig.IMAP.SaveSent {
+						s.shared.sent.save(state.serverConfig, data)
+					}
 				} else {
 					LogError("❌ Email failed to send from %s: %s", state.mailboxName, respText)
 					LogError("[%s] SMTP transaction failed", state.mailboxName)
@@ -552,17 +779,32 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				}
 
 				password := string(decoded)
+				ip := clientIP(localConn)
+				if s.shared.guard.banned(ip, state.authUsername) {
+					fmt.Fprintf(localConn, "421 4.7.0 Too many failed logins, try again later\r\n")
+					LogError("[%s] Refusing banned client %s", state.getMailboxIdentifier(), clientAddr)
+					return
+				}
+				if !s.shared.userPermits(state.authUsername, ip) {
+					fmt.Fprintf(localConn, "535 5.7.1 Access denied from this address\r\n")
+					LogError("[%s] Local user may not log in from %s", state.getMailboxIdentifier(), clientAddr)
+					state.authState = ""
+					continue
+				}
 				
 				// Find server config matching the username
-				serverConfig := s.findServerConfigByUsername(state.authUsername)
-				if serverConfig == nil || !s.validateCredentials(state.authUsername, password, serverConfig) {
+				serverConfig := s.checkCredentials(state.authUsername, password)
+				if serverConfig == nil {
+					time.Sleep(s.shared.guard.failure(ip, state.authUsername, "SMTP"))
 					fmt.Fprintf(localConn, "535 Authentication failed\r\n")
 					LogError("[%s] Authentication failed for client %s", state.getMailboxIdentifier(), clientAddr)
 					state.authState = ""
 					continue
 				}
+				s.shared.guard.success(ip, state.authUsername)
 
 				state.isAuthenticated = true
+				state.authState = ""
 				state.serverConfig = serverConfig
 				state.mailboxName = state.authUsername
 				fmt.Fprintf(localConn, "235 Authentication successful\r\n")
@@ -577,6 +819,21 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				continue
 			}
 			
+			// Queue mode has no upstream session to forward to
+			if s.shared.queue != nil && state.upstreamConn == nil {
+				switch command {
+				case "RSET":
+					state.mailFrom = ""
+					state.rcptTo = nil
+					fmt.Fprintf(localConn, "250 2.0.0 Ok\r\n")
+				case "NOOP":
+					fmt.Fprintf(localConn, "250 2.0.0 Ok\r\n")
+				default:
+					fmt.Fprintf(localConn, "502 5.5.2 Command not implemented\r\n")
+				}
+				continue
+			}
+
 			// Forward other commands to upstream if authenticated and connected
 			if state.upstreamConn != nil {
 				fmt.Fprintf(state.upstreamConn, "%s\r\n", line)
@@ -586,7 +843,7 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 				response, err := upstreamReader.ReadString('\n')
 				if err != nil {
 					LogError("[%s] Failed to read response for command %s: %v", state.mailboxName, command, err)
-					fmt.Fprintf(localConn, "451 Local error in processing\r\n")
+					fmt.Fprintf(localConn, "%s\r\n", upstreamErrorReply(err))
 					continue
 				}
 				
@@ -599,16 +856,80 @@ func (s *SMTPServer) handleSMTPSessionDynamic(localConn net.Conn, clientAddr str
 			}
 		}
 	}
+}
+
+// queueData receives a message and puts it in the outbound queue, answering
+// the client once it is on disk. It returns false when the session cannot
+// continue.
+func (s *SMTPServer) queueData(localConn net.Conn, clientReader *bufio.Reader, state *smtpState, clientAddr string) bool {
+	if state.mailFrom == "" {
+		fmt.Fprintf(localConn, "503 5.5.1 Need MAIL command\r\n")
+		return true
+	}
+	if len(state.rcptTo) == 0 {
+		fmt.Fprintf(localConn, "554 5.5.1 No valid recipients\r\n")
+		return true
+	}
+	fmt.Fprintf(localConn, "354 End data with <CR><LF>.<CR><LF>\r\n")
+	data, err := s.handleSMTPDataMode(localConn, clientReader, nil, clientAddr, state.mailboxName)
+	if err != nil {
+		LogError("[%s] Error in DATA mode: %v", state.mailboxName, err)
+		if isTimeout(err) {
+			fmt.Fprintf(localConn, "421 4.4.2 Timeout waiting for data, closing connection\r\n")
+		} else {
+			fmt.Fprintf(localConn, "421 4.3.0 Local error in processing, closing connection\r\n")
+		}
+		return false
+	}
+
+	id, err := s.shared.queue.enqueue(state.serverConfig, state.mailFrom, state.rcptTo, state.dsn, clientIP(localConn), unstuffData(data))
+	if err != nil {
+		LogError("[%s] Failed to queue message: %v", state.mailboxName, err)
+		s.recordJournal(localConn, state, data, "not queued: "+err.Error())
+		fmt.Fprintf(localConn, "451 4.3.0 Could not queue message, try again later\r\n")
+		return true
+	}
+	reply := "250 2.0.0 Ok: queued as " + id
+	s.recordJournal(localConn, state, data, reply)
+	fmt.Fprintf(localConn, "%s\r\n", reply)
+	return true
+}
 
-	// Cleanup
-	if state.upstreamConn != nil {
-		state.upstreamConn.Close()
+// recordJournal records a forwarded message and its envelope in the journal
+// and ends the transaction
+func (s *SMTPServer) recordJournal(localConn net.Conn, state *smtpState, data []byte, response string) {
+	s.shared.journal.record(journalRecord{
+		Kind:      "smtp",
+		ClientIP:  clientIP(localConn),
+		LocalUser: state.authUsername,
+		Upstream:  fmt.Sprintf("%s (%s)", state.serverConfig.SMTP.Username, state.serverConfig.Name),
+		MailFrom:  state.mailFrom,
+		RcptTo:    state.rcptTo,
+		Response:  response,
+	}, data)
+	state.mailFrom = ""
+	state.rcptTo = nil
+}
+
+// closeUpstream closes the session's upstream connection and frees its login slot
+func (s *SMTPServer) closeUpstream(state *smtpState) {
+	if state.upstreamConn == nil {
+		return
+	}
+	state.upstreamConn.Close()
+	state.upstreamConn = nil
+	if state.upstreamLogin != nil {
+		s.shared.logins.release(state.upstreamLogin)
+		state.upstreamLogin = nil
 	}
 }
 
 // findServerConfigByUsername finds a server config that matches the username (email address)
 func (s *SMTPServer) findServerConfigByUsername(email string) *ServerConfig {
 	for _, server := range s.config.Servers {
+		if !s.listenerConfig.AllowsServer(server.Name) {
+			continue
+		}
 		if server.SMTP != nil && server.SMTP.Username == email {
 			LogInfo("Found server config for mailbox: %s", email)
 			return &server
@@ -618,9 +939,31 @@ func (s *SMTPServer) findServerConfigByUsername(email string) *ServerConfig {
 	return nil
 }
 
+// checkCredentials returns the server config for a client login, or nil when the
+// credentials are wrong. Configured local users are checked against their local
+// password; anyone else must present the upstream SMTP credentials.
+func (s *SMTPServer) checkCredentials(username, password string) *ServerConfig {
+	if localUser := s.config.FindLocalUser(username); localUser != nil {
+		if !s.listenerConfig.AllowsServer(localUser.Server) {
+			return nil
+		}
+		serverConfig := s.config.GetServerByName(localUser.Server)
+		if serverConfig == nil || serverConfig.SMTP == nil || !passwordsEqual(localUser.Password, password) {
+			return nil
+		}
+		return serverConfig
+	}
+
+	serverConfig := s.findServerConfigByUsername(username)
+	if serverConfig == nil || !s.validateCredentials(username, password, serverConfig) {
+		return nil
+	}
+	return serverConfig
+}
+
 // validateCredentials validates the provided username and password against the server config
 func (s *SMTPServer) validateCredentials(username, password string, config *ServerConfig) bool {
-	return config.SMTP.Username == username && config.SMTP.Password == password
+	return config.SMTP.Username == username && passwordsEqual(config.SMTP.Password, password)
 }
 
 func (s *SMTPServer) handleSMTPSessionWithOptions(localConn, upstreamConn net.Conn, upstreamConfig *MailServerConfig, clientAddr string, skipGreeting bool) {
@@ -805,7 +1148,7 @@ func (s *SMTPServer) handleSMTPCommands(localConn, upstreamConn net.Conn, upstre
 					LogInfo("📧 EMAIL: Starting to receive message content for %s", upstreamConfig.Username)
 					
 					// Use binary-safe DATA handling to preserve original encoding
-					if err := s.handleSMTPDataMode(localConn, upstreamConn, clientAddr, upstreamConfig.Username); err != nil {
+					if _, err := s.handleSMTPDataMode(localConn, clientReader, upstreamConn, clientAddr, upstreamConfig.Username); err != nil {
 						LogError("❌ Error in DATA mode: %v", err)
 						fmt.Fprintf(localConn, "451 Local error in processing\r\n")
 						continue
@@ -954,10 +1297,9 @@ func (s *SMTPServer) upgradeToSTARTTLS(conn net.Conn, config *MailServerConfig,
 	}
 	
 	// Upgrade to TLS
-	tlsConn := tls.Client(conn, &tls.Config{ServerName: config.Host})
-	err := tlsConn.Handshake()
+	tlsConn, err := upstreamTLSHandshake(conn, config, s.config.Timeouts)
 	if err != nil {
-		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		return nil, err
 	}
 
 	// Send fresh EHLO after TLS upgrade (required by many servers)
@@ -985,20 +1327,36 @@ func (s *SMTPServer) upgradeToSTARTTLS(conn net.Conn, config *MailServerConfig,
 	return tlsConn, nil
 }
 
+// upstreamErrorReply picks the SMTP reply for a failed upstream exchange
+func upstreamErrorReply(err error) string {
+	if isTimeout(err) {
+		return "451 4.4.1 Upstream server not responding"
+	}
+	return "451 Local error in processing"
+}
+
 // extractEmailFromMailFrom extracts email address from MAIL FROM command
 func (s *SMTPServer) extractEmailFromMailFrom(line string) string {
 	// Extract email from "MAIL FROM:<email@domain.com>"
-	start := strings.Index(strings.ToUpper(line), "FROM:")
+	return extractAddress(line, "FROM:")
+}
+
+// extractAddress returns the address after keyword ("FROM:" or "TO:") in a
+// MAIL or RCPT command
+func extractAddress(line, keyword string) string {
+	start := strings.Index(strings.ToUpper(line), keyword)
 	if start == -1 {
 		return ""
 	}
 	
-	remainder := line[start+5:] // Skip "FROM:"
+	remainder := line[start+len(keyword):]
 	remainder = strings.TrimSpace(remainder)
 	
-	// Remove angle brackets if present
-	if strings.HasPrefix(remainder, "<") && strings.HasSuffix(remainder, ">") {
-		return remainder[1 : len(remainder)-1]
+	// Remove angle brackets if present; parameters such as SIZE= may follow
+	if strings.HasPrefix(remainder, "<") {
+		if end := strings.IndexByte(remainder, '>'); end > 0 {
+			return remainder[1:end]
+		}
 	}
 	
 	// Take first word (email address)
@@ -1014,6 +1372,9 @@ func (s *SMTPServer) extractEmailFromMailFrom(line string) string {
 func (s *SMTPServer) findServerConfigBySender(senderEmail string) *ServerConfig {
 	// First, try exact match
 	for _, server := range s.config.Servers {
+		if !s.listenerConfig.AllowsServer(server.Name) {
+			continue
+		}
 		if server.SMTP != nil && server.SMTP.Username == senderEmail {
 			return &server
 		}
@@ -1022,6 +1383,9 @@ func (s *SMTPServer) findServerConfigBySender(senderEmail string) *ServerConfig
 	// If no exact match, return the first available SMTP server
 	// This allows sending from any address using any configured mailbox
 	for _, server := range s.config.Servers {
+		if !s.listenerConfig.AllowsServer(server.Name) {
+			continue
+		}
 		if server.SMTP != nil {
 			LogInfo("SMTP fallback: Using mailbox %s for sender %s", server.SMTP.Username, senderEmail)
 			return &server
@@ -1033,22 +1397,16 @@ func (s *SMTPServer) findServerConfigBySender(senderEmail string) *ServerConfig
 
 // connectToUpstream establishes connection to upstream SMTP server
 func (s *SMTPServer) connectToUpstream(serverConfig *ServerConfig, clientAddr string) (net.Conn, error) {
-	upstreamAddr := fmt.Sprintf("%s:%d", serverConfig.SMTP.Host, serverConfig.SMTP.Port)
-	var upstreamConn net.Conn
-	var err error
+	upstreamAddr := upstreamAddr(serverConfig.SMTP)
 
 	LogInfo("SMTP connecting to upstream server %s for mailbox %s", upstreamAddr, serverConfig.SMTP.Username)
 
 	// For port 587, always start with plain connection (STARTTLS)
 	// For port 465, use direct TLS connection
-	if serverConfig.SMTP.Port == 465 && serverConfig.SMTP.UseTLS {
-		upstreamConn, err = tls.Dial("tcp", upstreamAddr, &tls.Config{ServerName: serverConfig.SMTP.Host})
-	} else {
-		upstreamConn, err = net.Dial("tcp", upstreamAddr)
-	}
-
+	implicitTLS := serverConfig.SMTP.Port == 465 && serverConfig.SMTP.UseTLS
+	upstreamConn, err := dialUpstream(serverConfig.SMTP, implicitTLS, s.config.Timeouts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to %s: %w", upstreamAddr, err)
+		return nil, err
 	}
 
 	// Handle STARTTLS upgrade if needed (port 587)
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sdNotify sends a state change such as "READY=1" to the service manager.
+// It does nothing when the proxy is not run by systemd with Type=notify.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	return nil
+}
+
+// watchdogInterval returns how often WATCHDOG=1 must be sent, or 0 when the
+// unit has no WatchdogSec
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog at half the configured interval until stop is closed
+func runWatchdog(stop <-chan struct{}) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	LogInfo("systemd watchdog enabled, interval %v", interval)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				LogError("%v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sdListenFDsStart is the first file descriptor passed by socket activation
+const sdListenFDsStart = 3
+
+// activatedSockets holds the listening sockets passed by systemd socket
+// activation (LISTEN_FDS) until the local listeners claim them
+type activatedSockets struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	names     []string
+}
+
+// systemdSockets collects the sockets passed by systemd, if any. The
+// environment variables are cleared so child processes do not inherit them.
+func systemdSockets() (*activatedSockets, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	sockets := &activatedSockets{}
+	for i := 0; i < count; i++ {
+		fd := sdListenFDsStart + i
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		listener, err := net.FileListener(file)
+		file.Close() // FileListener holds its own copy of the descriptor
+		if err != nil {
+			return nil, fmt.Errorf("socket activation: fd %d is not a TCP listening socket: %w", fd, err)
+		}
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		sockets.listeners = append(sockets.listeners, listener)
+		sockets.names = append(sockets.names, name)
+		LogInfo("Received socket %s (%s) from systemd", listener.Addr(), name)
+	}
+	return sockets, nil
+}
+
+// take hands out the activated socket for a listener: the one whose
+// FileDescriptorName equals the listener name, otherwise the first one on the
+// listener's port. It returns nil when there is none.
+func (a *activatedSockets) take(cfg ListenerConfig) net.Listener {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	index := -1
+	for i, name := range a.names {
+		if a.listeners[i] != nil && name == cfg.Name {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		for i, listener := range a.listeners {
+			if addr, ok := listenerTCPAddr(listener); ok && addr.Port == cfg.Port {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	listener := a.listeners[index]
+	a.listeners[index] = nil
+	return listener
+}
+
+// closeUnused logs activated sockets that no listener claimed and closes them
+func (a *activatedSockets) closeUnused() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, listener := range a.listeners {
+		if listener != nil {
+			LogInfo("Socket %s (%s) from systemd matches no configured listener, closing it", listener.Addr(), a.names[i])
+			listener.Close()
+			a.listeners[i] = nil
+		}
+	}
+}
+
+func listenerTCPAddr(listener net.Listener) (*net.TCPAddr, bool) {
+	if listener == nil {
+		return nil, false
+	}
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	return addr, ok
+}
@@ -42,6 +42,16 @@ if systemctl is-active --quiet proxy-mail; then
     print_success "Service stopped"
 fi
 
+if systemctl is-active --quiet proxy-mail.socket; then
+    print_status "Stopping proxy-mail socket..."
+    systemctl stop proxy-mail.socket
+    print_success "Socket stopped"
+fi
+
+if systemctl is-enabled --quiet proxy-mail.socket 2>/dev/null; then
+    systemctl disable proxy-mail.socket
+fi
+
 if systemctl is-enabled --quiet proxy-mail; then
     print_status "Disabling proxy-mail service..."
     systemctl disable proxy-mail
@@ -52,6 +62,7 @@ fi
 if [[ -f "/etc/systemd/system/proxy-mail.service" ]]; then
     print_status "Removing systemd service file..."
     rm /etc/systemd/system/proxy-mail.service
+    rm -f /etc/systemd/system/proxy-mail.socket
     systemctl daemon-reload
     print_success "Service file removed"
 fi
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// timeoutConn refreshes the read/write deadline before every I/O call, so a
+// hung upstream server fails the current operation instead of blocking forever
+type timeoutConn struct {
+	net.Conn
+	timeout atomic.Int64 // time.Duration
+}
+
+func newTimeoutConn(conn net.Conn, timeout time.Duration) *timeoutConn {
+	tc := &timeoutConn{Conn: conn}
+	tc.timeout.Store(int64(timeout))
+	return tc
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if d := time.Duration(c.timeout.Load()); d > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(d))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if d := time.Duration(c.timeout.Load()); d > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(d))
+	}
+	return c.Conn.Write(b)
+}
+
+// setUpstreamTimeout changes the per-operation timeout of a connection returned
+// by dialUpstream, looking through a TLS layer added by STARTTLS
+func setUpstreamTimeout(conn net.Conn, timeout time.Duration) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tc, ok := conn.(*timeoutConn); ok {
+		tc.timeout.Store(int64(timeout))
+	}
+}
+
+// isTimeout reports whether err was caused by an expired deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// upstreamAddr returns the host:port address of an upstream server
+func upstreamAddr(config *MailServerConfig) string {
+	return net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+}
+
+// dialUpstream connects to an upstream server, through the configured upstream
+// proxy if any, and performs the TLS handshake when useTLS is set. Every
+// upstream connection in the proxy goes through here.
+func dialUpstream(config *MailServerConfig, useTLS bool, timeouts TimeoutConfig) (net.Conn, error) {
+	addr := upstreamAddr(config)
+	var conn net.Conn
+	var err error
+	if config.proxy != nil {
+		conn, err = dialThroughProxy(config.proxy, addr, timeouts.UpstreamDial)
+		if err != nil {
+			return nil, err
+		}
+		LogDebug("Connected to %s through %s proxy %s", addr, config.proxy.Type, config.proxy.Address)
+	} else {
+		dialer := &net.Dialer{Timeout: timeouts.UpstreamDial}
+		conn, err = dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+		}
+	}
+
+	if useTLS {
+		tlsConn, err := upstreamTLSHandshake(conn, config, timeouts)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return newTimeoutConn(conn, timeouts.UpstreamResponse), nil
+}
+
+// upstreamTLSConfig builds the TLS client configuration for an upstream server
+// from its tls settings
+func upstreamTLSConfig(config *MailServerConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: config.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+	opts := config.TLS
+	if opts == nil {
+		return tlsConfig, nil
+	}
+
+	if opts.ServerName != "" {
+		tlsConfig.ServerName = opts.ServerName
+	}
+	if opts.MinVersion != "" {
+		version, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported min_version %q (use 1.0, 1.1, 1.2 or 1.3)", opts.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_file %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.PinnedSPKI) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range opts.PinnedSPKI {
+			pin = strings.TrimPrefix(pin, "sha256/")
+			if sum, err := base64.StdEncoding.DecodeString(pin); err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("pinned_spki %q is not a base64 SHA-256 hash", pin)
+			}
+			pins[pin] = true
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return checkSPKIPins(pins, rawCerts)
+		}
+	}
+
+	if opts.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+		if len(opts.PinnedSPKI) > 0 {
+			log.Printf("WARNING: %s: chain verification disabled, only pinned_spki is checked", upstreamAddr(config))
+		} else {
+			log.Printf("WARNING: %s: TLS certificate verification is DISABLED (insecure_skip_verify). "+
+				"Connections can be intercepted; use this in a lab only.", upstreamAddr(config))
+		}
+	}
+	return tlsConfig, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// checkSPKIPins succeeds when a certificate presented by the server has one of
+// the pinned public key hashes
+func checkSPKIPins(pins map[string]bool, rawCerts [][]byte) error {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return errors.New("server certificate does not match pinned_spki")
+}
+
+// upstreamTLSHandshake wraps conn in a TLS client and completes the handshake
+// within the configured timeout
+func upstreamTLSHandshake(conn net.Conn, config *MailServerConfig, timeouts TimeoutConfig) (*tls.Conn, error) {
+	tlsConfig := config.tlsConfig
+	if tlsConfig == nil {
+		// Not prepared by LoadConfig, so built here with the same defaults
+		var err error
+		if tlsConfig, err = upstreamTLSConfig(config); err != nil {
+			return nil, fmt.Errorf("TLS settings of %s: %w", upstreamAddr(config), err)
+		}
+	}
+	if tlsConfig.InsecureSkipVerify && len(config.TLS.PinnedSPKI) == 0 {
+		LogInfo("⚠️ TLS certificate of %s is NOT verified (insecure_skip_verify)", upstreamAddr(config))
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), timeouts.UpstreamTLSHandshake)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", upstreamAddr(config), err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// bufferedConn is a connection whose first bytes were already read into reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// dialThroughProxy opens a tunnel to addr through an upstream proxy. The whole
+// proxy handshake must complete within timeout.
+func dialThroughProxy(proxy *UpstreamProxyConfig, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", proxy.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s proxy %s: %w", proxy.Type, proxy.Address, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	switch proxy.Type {
+	case "socks5":
+		err = socks5Connect(conn, proxy, addr)
+	case "http":
+		conn, err = httpConnect(conn, proxy, addr)
+	default:
+		err = fmt.Errorf("unsupported proxy type %q", proxy.Type)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s proxy %s could not reach %s: %w", proxy.Type, proxy.Address, addr, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect performs the RFC 1928 CONNECT handshake, authenticating with
+// RFC 1929 username/password when configured. The host name is resolved by the proxy.
+func socks5Connect(conn net.Conn, proxy *UpstreamProxyConfig, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	if len(host) > 255 {
+		return errors.New("host name too long for SOCKS5")
+	}
+
+	method := byte(0x00) // no authentication
+	if proxy.Username != "" {
+		method = 0x02 // username/password
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", reply[0])
+	}
+	if reply[1] != method {
+		return errors.New("proxy refused the authentication method")
+	}
+
+	if method == 0x02 {
+		auth := []byte{0x01, byte(len(proxy.Username))}
+		auth = append(auth, proxy.Username...)
+		auth = append(auth, byte(len(proxy.Password)))
+		auth = append(auth, proxy.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("proxy authentication failed")
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, 0x01)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("CONNECT refused: %s", socks5ReplyText(header[1]))
+	}
+	// Skip the bound address that follows
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = 4
+	case 0x04:
+		skip = 16
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("invalid SOCKS5 address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func socks5ReplyText(code byte) string {
+	switch code {
+	case 0x01:
+		return "general failure"
+	case 0x02:
+		return "not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	default:
+		return fmt.Sprintf("error %d", code)
+	}
+}
+
+// httpConnect opens a tunnel with an HTTP CONNECT request, using Basic
+// authentication when configured
+func httpConnect(conn net.Conn, proxy *UpstreamProxyConfig, addr string) (net.Conn, error) {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if proxy.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	request += "\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT refused: %s", resp.Status)
+	}
+
+	// IMAP and SMTP servers speak first, so the greeting may already be buffered
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
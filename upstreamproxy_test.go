@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProxy accepts one connection and answers it with handle, which
+// returns an error message when the client sent something unexpected
+func fakeProxy(t *testing.T, handle func(conn net.Conn) string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		done <- handle(conn)
+		// Keep the tunnel open until the client is done with it
+		io.Copy(io.Discard, conn)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		if problem := <-done; problem != "" {
+			t.Error("proxy: " + problem)
+		}
+	})
+	return listener.Addr().String()
+}
+
+// expect reads len(want) bytes and reports whether they are want
+func expect(conn net.Conn, want []byte) string {
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err.Error()
+	}
+	if !bytes.Equal(got, want) {
+		return "got " + string(got) + ", want " + string(want)
+	}
+	return ""
+}
+
+// socks5Request is the CONNECT request for imap.example.com:993
+var socks5Request = append([]byte{0x05, 0x01, 0x00, 0x03, 16}, "imap.example.com\x03\xe1"...)
+
+func TestDialThroughProxy(t *testing.T) {
+	greeting := "* OK IMAP4rev1 ready\r\n"
+	tests := []struct {
+		name     string
+		proxy    UpstreamProxyConfig
+		handle   func(conn net.Conn) string
+		wantErr  string
+		greeting string // read through the tunnel when the dial succeeds
+	}{
+		{
+			name:  "socks5 without authentication",
+			proxy: UpstreamProxyConfig{Type: "socks5"},
+			handle: func(conn net.Conn) string {
+				if problem := expect(conn, []byte{0x05, 0x01, 0x00}); problem != "" {
+					return problem
+				}
+				conn.Write([]byte{0x05, 0x00})
+				if problem := expect(conn, socks5Request); problem != "" {
+					return problem
+				}
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 10, 0, 0, 1, 0x1f, 0x90})
+				conn.Write([]byte(greeting))
+				return ""
+			},
+			greeting: greeting,
+		},
+		{
+			name:  "socks5 with username and password",
+			proxy: UpstreamProxyConfig{Type: "socks5", Username: "user", Password: "pass"},
+			handle: func(conn net.Conn) string {
+				if problem := expect(conn, []byte{0x05, 0x01, 0x02}); problem != "" {
+					return problem
+				}
+				conn.Write([]byte{0x05, 0x02})
+				if problem := expect(conn, []byte("\x01\x04user\x04pass")); problem != "" {
+					return problem
+				}
+				conn.Write([]byte{0x01, 0x00})
+				if problem := expect(conn, socks5Request); problem != "" {
+					return problem
+				}
+				// A domain name as bound address, with the greeting in the same packet
+				reply := append([]byte{0x05, 0x00, 0x00, 0x03, 5}, "proxy\x1f\x90"...)
+				conn.Write(append(reply, greeting...))
+				return ""
+			},
+			greeting: greeting,
+		},
+		{
+			name:  "socks5 with rejected credentials",
+			proxy: UpstreamProxyConfig{Type: "socks5", Username: "user", Password: "wrong"},
+			handle: func(conn net.Conn) string {
+				if problem := expect(conn, []byte{0x05, 0x01, 0x02}); problem != "" {
+					return problem
+				}
+				conn.Write([]byte{0x05, 0x02})
+				if problem := expect(conn, []byte("\x01\x04user\x05wrong")); problem != "" {
+					return problem
+				}
+				conn.Write([]byte{0x01, 0x01})
+				return ""
+			},
+			wantErr: "proxy authentication failed",
+		},
+		{
+			name:  "http connect",
+			proxy: UpstreamProxyConfig{Type: "http", Username: "user", Password: "pass"},
+			handle: func(conn net.Conn) string {
+				reader := bufio.NewReader(conn)
+				var request []string
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return err.Error()
+					}
+					if line == "\r\n" {
+						break
+					}
+					request = append(request, strings.TrimSpace(line))
+				}
+				want := "CONNECT imap.example.com:993 HTTP/1.1|Host: imap.example.com:993|Proxy-Authorization: Basic dXNlcjpwYXNz"
+				if got := strings.Join(request, "|"); got != want {
+					return "got request " + got
+				}
+				// The server greets in the same packet as the proxy's answer
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n" + greeting))
+				return ""
+			},
+			greeting: greeting,
+		},
+		{
+			name:  "http connect refused",
+			proxy: UpstreamProxyConfig{Type: "http"},
+			handle: func(conn net.Conn) string {
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return err.Error()
+					}
+					if line == "\r\n" {
+						break
+					}
+				}
+				conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+				return ""
+			},
+			wantErr: "CONNECT refused: 403 Forbidden",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := tt.proxy
+			proxy.Address = fakeProxy(t, tt.handle)
+			conn, err := dialThroughProxy(&proxy, "imap.example.com:993", 5*time.Second)
+			if tt.wantErr != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("dial succeeded, want error %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != tt.greeting {
+				t.Errorf("got greeting %q, want %q", line, tt.greeting)
+			}
+		})
+	}
+}
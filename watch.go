@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// watchRetryMin and watchRetryMax bound the delay before a failed watch reconnects
+	watchRetryMin = 30 * time.Second
+	watchRetryMax = 5 * time.Minute
+	// hookTimeout bounds a webhook request or exec hook
+	hookTimeout = 30 * time.Second
+)
+
+// watchedFolder is the folder the watcher follows; other folders are listed at PASS
+const watchedFolder = "INBOX"
+
+// mailboxWatcher keeps one connection per watched mailbox in IDLE (or polls
+// with NOOP when the server has no IDLE), so the message list of the INBOX is
+// known before a POP3 client logs in. New mail can be prefetched into the
+// message cache and reported to hooks.
+type mailboxWatcher struct {
+	cfg      WatchConfig
+	timeouts TimeoutConfig
+	logins   *loginLimiter
+	cache    *messageCache
+
+	mu        sync.Mutex
+	snapshots map[string]*folderSnapshot // by loginKey
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// newMailEvent is reported to hooks when messages arrive in a watched mailbox
+type newMailEvent struct {
+	Server  string `json:"server"`
+	Mailbox string `json:"mailbox"` // upstream username
+	Folder  string `json:"folder"`
+	UIDs    []int  `json:"uids"`
+	Exists  int    `json:"exists"` // messages in the folder after the arrival
+}
+
+func newMailboxWatcher(config *Config, logins *loginLimiter, cache *messageCache) *mailboxWatcher {
+	w := &mailboxWatcher{
+		cfg:       config.Watch,
+		timeouts:  config.Timeouts,
+		logins:    logins,
+		cache:     cache,
+		snapshots: make(map[string]*folderSnapshot),
+		stop:      make(chan struct{}),
+	}
+	for _, name := range config.Watch.Servers {
+		server := config.GetServerByName(name)
+		w.wg.Add(1)
+		go w.watch(server.Name, server.IMAP)
+	}
+	return w
+}
+
+// snapshot returns the last known state of a watched folder, or nil
+func (w *mailboxWatcher) snapshot(config *MailServerConfig, folder string) *folderSnapshot {
+	if w == nil || !strings.EqualFold(folder, watchedFolder) {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.snapshots[loginKey(config)]
+}
+
+// close ends all watches and logs their connections out
+func (w *mailboxWatcher) close() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// watch keeps a mailbox watched, reconnecting with growing delays after failures
+func (w *mailboxWatcher) watch(server string, config *MailServerConfig) {
+	defer w.wg.Done()
+	retry := watchRetryMin
+	for {
+		started := time.Now()
+		err := w.session(server, config)
+		w.publish(config, nil)
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		if time.Since(started) > watchRetryMax {
+			retry = watchRetryMin
+		}
+		LogError("Watching %s (%s) failed, retrying in %v: %v", config.Username, server, retry, err)
+		select {
+		case <-time.After(retry):
+		case <-w.stop:
+			return
+		}
+		if retry *= 2; retry > watchRetryMax {
+			retry = watchRetryMax
+		}
+	}
+}
+
+// session logs in, lists the INBOX and follows its changes until the
+// connection fails or the watcher is closed
+func (w *mailboxWatcher) session(server string, config *MailServerConfig) error {
+	if !w.logins.acquire(config) {
+		return errUpstreamLoginLimit
+	}
+	defer w.logins.release(config)
+	c, err := dialIMAP(config, w.timeouts, "watch")
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+
+	status, err := c.selectStatus(watchedFolder)
+	if err != nil {
+		return err
+	}
+	messages, err := c.listMessages(1, status.Exists)
+	if err != nil {
+		return err
+	}
+	snap := &folderSnapshot{folderStatus: status, Messages: messages}
+	for i := range snap.Messages {
+		snap.Messages[i].Folder = watchedFolder
+		snap.Messages[i].UIDValidity = status.UIDValidity
+	}
+	w.publish(config, snap)
+	LogInfo("Watching %s of %s (%s): %d emails, %s", watchedFolder, config.Username, server, status.Exists, w.mode(c))
+
+	for {
+		// Expunges renumber the messages after them, so they are applied as they arrive
+		exists := len(snap.Messages)
+		handle := func(line string) {
+			if n, ok := parseCountResponse(line, "EXPUNGE"); ok && n >= 1 && n <= len(snap.Messages) {
+				snap.Messages = append(snap.Messages[:n-1], snap.Messages[n:]...)
+				exists--
+			} else if n, ok := parseCountResponse(line, "EXISTS"); ok {
+				exists = n
+			}
+		}
+		if c.caps["IDLE"] {
+			err = c.idle(w.cfg.IdleRefresh, w.stop, handle)
+		} else {
+			select {
+			case <-time.After(w.cfg.PollInterval):
+				_, err = c.command(handle, "NOOP")
+			case <-w.stop:
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-w.stop:
+			return nil
+		default:
+		}
+
+		var arrived []IMAPMessage
+		if exists > len(snap.Messages) {
+			arrived, err = c.listMessages(len(snap.Messages)+1, exists)
+			if err != nil {
+				return err
+			}
+			for i := range arrived {
+				arrived[i].Folder = watchedFolder
+				arrived[i].UIDValidity = snap.UIDValidity
+			}
+			snap.Messages = append(snap.Messages, arrived...)
+		}
+		// UIDNEXT also moves past messages that came and went between two
+		// checks, so it is asked for instead of derived from the arrivals
+		if snap.UIDNext, err = c.uidNext(watchedFolder); err != nil {
+			return err
+		}
+		snap.Exists = len(snap.Messages)
+		w.publish(config, snap)
+
+		if len(arrived) > 0 {
+			w.newMail(c, server, config, arrived, snap.Exists)
+		}
+	}
+}
+
+func (w *mailboxWatcher) mode(c *imapClient) string {
+	if c.caps["IDLE"] {
+		return "using IDLE"
+	}
+	return fmt.Sprintf("polling every %v", w.cfg.PollInterval)
+}
+
+// publish stores a copy of the snapshot for POP3 sessions; nil forgets it
+func (w *mailboxWatcher) publish(config *MailServerConfig, snap *folderSnapshot) {
+	var published *folderSnapshot
+	if snap != nil {
+		published = &folderSnapshot{folderStatus: snap.folderStatus, Messages: append([]IMAPMessage(nil), snap.Messages...)}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if published == nil {
+		delete(w.snapshots, loginKey(config))
+	} else {
+		w.snapshots[loginKey(config)] = published
+	}
+}
+
+// newMail prefetches new messages into the cache and runs the hooks
+func (w *mailboxWatcher) newMail(c *imapClient, server string, config *MailServerConfig, arrived []IMAPMessage, exists int) {
+	event := newMailEvent{Server: server, Mailbox: config.Username, Folder: watchedFolder, Exists: exists}
+	for _, msg := range arrived {
+		event.UIDs = append(event.UIDs, msg.UID)
+	}
+	LogInfo("📬 NEW MAIL: %d new emails in %s of %s (%s)", len(arrived), watchedFolder, config.Username, server)
+
+	if w.cfg.Prefetch {
+		cacheKey := ""
+		if arrived[0].UIDValidity != 0 {
+			cacheKey = loginKey(config) + "/" + watchedFolder
+		}
+		for _, msg := range arrived {
+			if !w.cache.accepts(cacheKey, int64(msg.Size)) {
+				continue
+			}
+			data, err := c.fetchMessage(msg.UID)
+			if err != nil {
+				LogError("Prefetching message UID %d of %s failed: %v", msg.UID, config.Username, err)
+				break
+			}
+			w.cache.put(cacheKey, msg.UIDValidity, msg.UID, data)
+		}
+	}
+
+	// Hooks run in the background so a slow receiver does not stall the watch
+	if w.cfg.Webhook != "" {
+		go w.postWebhook(event)
+	}
+	if w.cfg.Exec != "" {
+		go w.runExec(event)
+	}
+}
+
+// postWebhook sends a new-mail event to the webhook as JSON
+func (w *mailboxWatcher) postWebhook(event newMailEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		LogError("Webhook: %v", err)
+		return
+	}
+	client := &http.Client{Timeout: hookTimeout}
+	resp, err := client.Post(w.cfg.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		LogError("Webhook %s failed: %v", w.cfg.Webhook, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		LogError("Webhook %s answered %s", w.cfg.Webhook, resp.Status)
+		return
+	}
+	LogDebug("Webhook %s notified of %d new emails for %s", w.cfg.Webhook, len(event.UIDs), event.Mailbox)
+}
+
+// runExec runs the exec hook with the event in its environment
+func (w *mailboxWatcher) runExec(event newMailEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	uids := make([]string, len(event.UIDs))
+	for i, uid := range event.UIDs {
+		uids[i] = strconv.Itoa(uid)
+	}
+	cmd := exec.CommandContext(ctx, w.cfg.Exec)
+	cmd.Env = append(os.Environ(),
+		"PROXY_MAIL_SERVER="+event.Server,
+		"PROXY_MAIL_MAILBOX="+event.Mailbox,
+		"PROXY_MAIL_FOLDER="+event.Folder,
+		"PROXY_MAIL_UIDS="+strings.Join(uids, ","),
+		"PROXY_MAIL_NEW="+strconv.Itoa(len(event.UIDs)),
+		"PROXY_MAIL_EXISTS="+strconv.Itoa(event.Exists),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		LogError("Exec hook %s failed: %v: %s", w.cfg.Exec, err, strings.TrimSpace(string(output)))
+		return
+	}
+	log.Printf("[WATCH] Exec hook %s ran for %d new emails of %s", w.cfg.Exec, len(event.UIDs), event.Mailbox)
+}